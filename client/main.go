@@ -3,24 +3,30 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
 	"path"
 	"strconv"
 	"strings"
 
 	c "github.com/elvizlai/sskcp/config"
+	"github.com/elvizlai/sskcp/kcptun"
 	kcpc "github.com/elvizlai/sskcp/kcptun/client"
 	ss "github.com/elvizlai/sskcp/shadowsocks"
 	ssc "github.com/elvizlai/sskcp/ss/client"
+	"github.com/elvizlai/sskcp/ss/plugin"
+	"github.com/elvizlai/sskcp/ss/uri"
 )
 
 func main() {
 	log.SetOutput(os.Stdout)
 
-	var configFile, cmdServer, cmdLocal string
+	var configFile, cmdServer, cmdLocal, rulesFile, statusAddr, pluginName, pluginOpts, ssURI, subURL string
 	var cmdConfig ss.Config
-	var printVer, kcpOff bool
+	var printVer, kcpOff, udp bool
+	var redirPort int
 
 	flag.BoolVar(&printVer, "version", false, "print version")
 	flag.StringVar(&configFile, "c", "config.json", "specify config file")
@@ -29,15 +35,41 @@ func main() {
 	flag.StringVar(&cmdConfig.Password, "k", "", "password")
 	flag.IntVar(&cmdConfig.ServerPort, "p", 0, "server port")
 	flag.IntVar(&cmdConfig.Timeout, "t", 300, "timeout in seconds")
-	flag.IntVar(&cmdConfig.LocalPort, "l", 0, "local socks5 proxy port")
+	flag.IntVar(&cmdConfig.LocalPort, "l", 0, "local proxy port, serves socks5, socks4/4a and http")
 	flag.StringVar(&cmdConfig.Method, "m", "", "encryption method, default: aes-256-cfb")
 	flag.BoolVar((*bool)(&ssc.Debug), "d", false, "print debug message")
 	flag.BoolVar(&cmdConfig.Auth, "A", false, "one time auth")
+	flag.IntVar(&redirPort, "redir", 0, "transparent proxy port for iptables REDIRECT (tcp) and TPROXY (udp), linux only")
+	flag.BoolVar(&udp, "u", false, "relay UDP of the transparent proxy, server must enable UDP relay")
+	flag.StringVar(&statusAddr, "status", "", "listen address of the status endpoint, e.g. 127.0.0.1:1090")
+	flag.StringVar(&rulesFile, "rules", "", "rule file deciding direct, proxy or reject per request, reloaded on SIGHUP")
+	flag.StringVar(&pluginName, "plugin", "", "SIP003 plugin to reach the servers through, e.g. obfs-local")
+	flag.StringVar(&pluginOpts, "plugin-opts", "", "options of the SIP003 plugin, e.g. obfs=http;obfs-host=www.bing.com")
+	flag.StringVar(&ssURI, "url", "", "ss:// URI of the server, SIP002 with plugin parameters")
+	flag.StringVar(&subURL, "sub", "", "subscription URL or file of the servers, SIP008 or base64 ss:// URIs, refreshed hourly")
 
 	flag.IntVar(&c.SndWnd, "snd", 128, "set send window size(num of packets)")
 	flag.IntVar(&c.RcvWnd, "rcv", 512, "set receive window size(num of packets)")
 	flag.IntVar(&c.DSCP, "dscp", 46, "set DSCP(6bit)")
 	flag.IntVar(&c.Conn, "conn", 1, "set num of UDP connections to server")
+	flag.StringVar(&c.Compress, "compress", "snappy", "set compression: none, snappy, zstd or lz4")
+	flag.BoolVar(&c.AutoCompress, "autocompress", false, "only compress while it shrinks the data")
+	flag.IntVar(&c.MTU, "mtu", 0, "set maximum transmission unit for UDP packets within 547-1471, 0 to discover the path MTU")
+	flag.StringVar(&c.Transport, "transport", "kcp", "set tunnel transport: kcp, quic, ws or wss")
+	flag.StringVar(&c.WSPath, "wspath", "/", "set websocket path")
+	flag.StringVar(&c.WSHost, "wshost", "", "set websocket Host header, default the host of the websocket url")
+	flag.StringVar(&c.WSURL, "wsurl", "", "set websocket url to dial instead of the server host, port and -wspath, e.g. wss://cdn.example.com/path")
+	flag.StringVar(&c.Fallback, "fallback", "", "carry the tunnel over tcp or tls while UDP to the server is blocked")
+	flag.StringVar(&c.TLSServerName, "tlsname", "", "set server name to verify over tls, quic or wss, default the websocket host or server host")
+	flag.BoolVar(&c.TLSInsecure, "tlsinsecure", false, "skip verifying the server certificate over tls, quic or wss")
+	flag.IntVar(&c.DataShard, "datashard", 10, "set reed-solomon data shards, the same as the server's")
+	flag.IntVar(&c.ParityShard, "parity", 3, "set initial reed-solomon parity shards")
+	flag.IntVar(&c.MinParityShard, "minparity", 0, "set minimum parity shards when adapting to loss, with a single server only")
+	flag.IntVar(&c.MaxParityShard, "maxparity", 6, "set maximum parity shards when adapting to loss")
+	flag.StringVar(&c.MuxPolicy, "muxpolicy", "least-loaded", "pick a connection per stream by least-loaded or round-robin")
+	flag.StringVar(&c.Key, "key", c.Key, "pre-shared secret of the kcp tunnel, the same on both ends")
+	flag.StringVar(&c.Obfs, "obfs", "", "obfuscate kcp packets with a fake header: plain, dtls or webrtc, the same on both ends")
+	flag.StringVar(&c.ObfsLength, "obfslen", "random:128", "set obfuscated packet lengths: none, random:MAX, fixed:SIZE, uniform:MIN-MAX or normal:MEAN,STDDEV")
 
 	flag.IntVar(&c.NoDelay, "nodelay", 0, "set mode param nodelay")
 	flag.IntVar(&c.Interval, "interval", 30, "set mode param interval")
@@ -51,6 +83,46 @@ func main() {
 		os.Exit(0)
 	}
 
+	if remote, local, opts, ok := plugin.FromEnv(); ok {
+		// run as the SIP003 plugin of another shadowsocks implementation,
+		// only the KCP tunnel between the addresses it gives
+		if err := plugin.SetFlags(opts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		log.Println("running as SIP003 plugin:", local, "<->", remote)
+		kcpc.RunClient(remote, local)
+		return
+	}
+
+	if ssURI != "" {
+		srv, err := uri.Parse(ssURI)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cmdServer = srv.Host
+		cmdConfig.ServerPort = srv.Port
+		cmdConfig.Method = srv.Method
+		cmdConfig.Password = srv.Password
+		if srv.Plugin == plugin.KCPClient {
+			// our own tunnel, the URI has the KCP port
+			if srv.Port <= kcptun.PortOffset {
+				fmt.Fprintf(os.Stderr, "kcp port %d of %s below %d\n", srv.Port, srv.Host, kcptun.PortOffset)
+				os.Exit(1)
+			}
+			if err := plugin.SetFlags(srv.PluginOpts); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			cmdConfig.ServerPort -= kcptun.PortOffset
+		} else {
+			// not an sskcp server, reach it directly or through its plugin
+			kcpOff = true
+			pluginName, pluginOpts = srv.Plugin, srv.PluginOpts
+		}
+	}
+
 	cmdConfig.Server = cmdServer
 	ss.SetDebug(ssc.Debug)
 
@@ -79,10 +151,36 @@ func main() {
 	} else {
 		ss.UpdateConfig(config, &cmdConfig)
 	}
+	cliConfig, err := ssc.ParseConfig(configFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "error reading %s: %v\n", configFile, err)
+			os.Exit(1)
+		}
+		cliConfig = &ssc.Config{}
+	}
+	if rulesFile != "" {
+		cliConfig.Rules = rulesFile
+	}
+	if statusAddr != "" {
+		cliConfig.Status = statusAddr
+	}
+	if pluginName != "" {
+		cliConfig.Plugin = pluginName
+		cliConfig.PluginOpts = pluginOpts
+	}
+	if subURL != "" {
+		cliConfig.Subscription = &ssc.Subscription{URL: subURL}
+	}
 	if config.Method == "" {
 		config.Method = "aes-256-cfb"
 	}
-	if len(config.ServerPassword) == 0 {
+	if cliConfig.Subscription != nil {
+		if config.LocalPort == 0 {
+			fmt.Fprintln(os.Stderr, "must specify local port")
+			os.Exit(1)
+		}
+	} else if len(config.ServerPassword) == 0 {
 		if !ssc.EnoughOptions(config) {
 			fmt.Fprintln(os.Stderr, "must specify server address, password and both server/local port")
 			os.Exit(1)
@@ -97,14 +195,75 @@ func main() {
 		}
 	}
 
+	var tunnel func(string) string
+	var kcpTunnel func(string) (string, io.Closer)
 	if !kcpOff {
-		config.Server = "127.0.0.1"
-		config.ServerPort = 10000 + config.ServerPort
-		portStr := strconv.Itoa(config.ServerPort)
-		go kcpc.RunClient(cmdServer+":"+portStr, fmt.Sprint(config.Server)+":"+portStr)
+		// every server gets its own KCP client on a free local port, the KCP
+		// server listens on the shadowsocks port plus kcptun.PortOffset;
+		// closing the port stops the client
+		kcpTunnel = func(server string) (string, io.Closer) {
+			host, port, err := net.SplitHostPort(server)
+			kcptun.CheckError(err)
+			portNumeric, err := strconv.Atoi(port)
+			kcptun.CheckError(err)
+			ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			kcptun.CheckError(err)
+			go kcpc.ServeClient(ln, net.JoinHostPort(host, strconv.Itoa(kcptun.PortOffset+portNumeric)))
+			return ln.Addr().String(), ln
+		}
+		tunnel = func(server string) string {
+			local, _ := kcpTunnel(server)
+			return local
+		}
+	}
+
+	if err = ssc.SetStrategy(cliConfig.Strategy); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if cliConfig.Subscription != nil {
+		// the subscribed servers bring their own plugins
+		if err = ssc.RunSubscription(cliConfig.Subscription, kcpTunnel); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else {
+		if cliConfig.Plugin != "" {
+			tunnel = ssc.PluginTunnel(cliConfig.Plugin, cliConfig.PluginOpts, tunnel)
+		}
+		ssc.ParseServerConfig(config, tunnel)
+	}
+
+	if cliConfig.Rules != "" {
+		if err = ssc.LoadRules(cliConfig.Rules); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		go ssc.WaitSignal()
+	}
+
+	if cliConfig.Health != nil {
+		go ssc.RunHealthCheck(cliConfig.Health)
+	}
+	if cliConfig.Status != "" {
+		go ssc.RunStatus(cliConfig.Status)
 	}
 
-	ssc.ParseServerConfig(config)
+	for _, fw := range cliConfig.Forwards {
+		go ssc.RunForward(fw.Local, fw.Remote)
+	}
+
+	if cliConfig.DNS != nil {
+		go ssc.RunDNS(cliConfig.DNS)
+	}
+
+	if redirPort != 0 {
+		redirAddr := cmdLocal + ":" + strconv.Itoa(redirPort)
+		go ssc.RunRedir(redirAddr)
+		if udp {
+			go ssc.RunRedirUDP(redirAddr)
+		}
+	}
 
 	ssc.Run(cmdLocal + ":" + strconv.Itoa(config.LocalPort))
 }
@@ -6,9 +6,84 @@ var RcvWnd = 1024 // set receive window size(num of packets)
 var DSCP = 46 // set DSCP(6bit), using EF
 var Conn = 1
 
+// MuxPolicy selects among the Conn sessions: "least-loaded" or "round-robin"
+var MuxPolicy = "least-loaded"
+
 var SnmpLog = "log"
 var SnmpPeriod = 60
 
+// reed-solomon erasure coding - datashard, the same on both ends
+var DataShard = 10
+
+// reed-solomon erasure coding - parityshard, adapted to the loss between the
+// bounds by a client with a single tunnel, the server enforces its own bounds
+var (
+	ParityShard    = 3 // of the first session
+	MinParityShard = 0
+	MaxParityShard = 6
+)
+
+// MTU sets the maximum transmission unit for UDP packets, 0 discovers the
+// path MTU per session
+var MTU = 0
+
+// Compress sets the compression of the tunnel: none, snappy, zstd or lz4, the
+// server follows the client
+var Compress = "snappy"
+
+// AllowCompress lists the compressions a server accepts from clients, the
+// others get none
+var AllowCompress = "none,snappy,zstd,lz4"
+
+// AutoCompress only compresses while it shrinks the data, most traffic is
+// encrypted already
+var AutoCompress = false
+
+// Transport of the client's tunnel, "kcp", "quic", "ws" or "wss"
+var Transport = "kcp"
+
+// QUIC makes the server also accept QUIC tunnels on its KCP port
+var QUIC = false
+
+// WS makes the server take the tunnel over WebSocket instead of the TCP
+// fallback, over TLS with TLSCert and TLSKey set
+var WS = false
+
+// WebSocket path, and the Host header the client sends, default the server's
+var (
+	WSPath = "/"
+	WSHost = ""
+)
+
+// WSURL is the WebSocket URL the client dials instead of the one at WSPath of
+// its server, e.g. of a CDN. The server shares it with its clients
+var WSURL = ""
+
+// Obfs obfuscates KCP packets with a fake "plain", "dtls" or "webrtc" header,
+// padded to lengths of ObfsLength, see kcptun.ParseLengthDist. Both ends need
+// the same settings, "" disables it
+var (
+	Obfs       = ""
+	ObfsLength = "random:128"
+)
+
+// Fallback carries the tunnel over "tcp" or "tls" while UDP to the server is
+// blocked, "" disables it
+var Fallback = ""
+
+// TCP makes the server accept the fallback transport, over TLS with TLSCert
+// and TLSKey set
+var TCP = false
+
+// certificates of the TLS fallback and of QUIC, whose server makes a
+// self-signed one without TLSCert and TLSKey
+var (
+	TLSCert       string
+	TLSKey        string
+	TLSServerName string // the client verifies, default the server's host
+	TLSInsecure   bool   // the client skips verifying the certificate
+)
+
 // fast3
 var (
 	NoDelay      = 1
@@ -17,17 +92,15 @@ var (
 	NoCongestion = 1
 )
 
+// Key is the pre-shared secret between client and server
+var Key = "1024"
+
 const (
 	SALT       = "kcp-go" // SALT is use for pbkdf2 key expansion
-	Key        = "1024"   // pre-shared secret between client and server
 	AutoExpire = 0        // set auto expiration time(in seconds) for a single UDP connection, 0 to disable
 	SockBuf    = 4194304  // socket buffer size in bytes
 	KeepAlive  = 10
 
-	DataShard   = 10 // set reed-solomon erasure coding - datashard
-	ParityShard = 3  // set reed-solomon erasure coding - parityshard
-
-	MTU         = 1350 // set maximum transmission unit for UDP packets
 	AckNodelay  = true // flush ack immediately when a packet is received
 	ScavengeTTL = 600  // set how long an expired connection can live(in sec), -1 to disable
 )
@@ -2,21 +2,26 @@ package client
 
 import (
 	"crypto/sha1"
+	"crypto/tls"
+	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/elvizlai/sskcp/kcptun"
 	c "github.com/elvizlai/sskcp/config"
+	"github.com/elvizlai/sskcp/kcptun"
+	"github.com/elvizlai/sskcp/ss/netutil"
 	"github.com/pkg/errors"
 	kcp "github.com/xtaci/kcp-go"
 	"github.com/xtaci/smux"
 	"golang.org/x/crypto/pbkdf2"
 )
 
-func handleClient(sess *smux.Session, p1 io.ReadWriteCloser) {
+func handleClient(sess kcptun.Mux, p1 io.ReadWriteCloser) {
 	log.Println("stream opened")
 	defer log.Println("stream closed")
 	defer p1.Close()
@@ -51,104 +56,427 @@ func handleClient(sess *smux.Session, p1 io.ReadWriteCloser) {
 }
 
 func RunClient(remoteAddr, localAddr string) {
-	rand.Seed(int64(time.Now().Nanosecond()))
-
 	addr, err := net.ResolveTCPAddr("tcp", localAddr)
 	kcptun.CheckError(err)
 	listener, err := net.ListenTCP("tcp", addr)
 	kcptun.CheckError(err)
+	ServeClient(listener, remoteAddr)
+}
 
-	pass := pbkdf2.Key([]byte(c.Key), []byte(c.SALT), 4096, 32, sha1.New)
-	block, _ := kcp.NewAESBlockCrypt(pass)
+// client keeps c.Conn sessions to a KCP server, each reconnected in the
+// background by its own monitor.
+type client struct {
+	remoteAddr  string
+	block       kcp.BlockCrypt
+	obfsKey     []byte
+	smuxConfig  *smux.Config
+	muxes       []*mux
+	rr          uint32
+	parity      int32       // of new sessions
+	adaptiveFEC int32       // the server takes CtrlFEC proposals
+	udpBlocked  int32       // sessions use the fallback transport
+	udpFails    int32       // sessions that failed over UDP in a row
+	tlsConfig   *tls.Config // of the fallback transport or wss
+	wsURL       string
+	quicTLS     *tls.Config
+	codec       byte
+	chScavenger chan kcptun.Mux
+	die         chan struct{} // closed with the listener
+}
 
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.MaxReceiveBuffer = c.SockBuf
-	smuxConfig.KeepAliveInterval = time.Duration(c.KeepAlive) * time.Second
+// tunnel is a session to the server and its control stream.
+type tunnel struct {
+	session   kcptun.Mux
+	ctrl      *kcptun.Control
+	transport string
+	parity    int // over KCP
+}
 
-	createConn := func() (*smux.Session, error) {
-		kcpconn, err := kcp.DialWithOptions(remoteAddr, block, c.DataShard, c.ParityShard)
-		if err != nil {
-			return nil, errors.Wrap(err, "createConn()")
+func (cl *client) hello(transport string) *kcptun.Hello {
+	return &kcptun.Hello{
+		Version:      kcptun.ProtocolVersion,
+		Transport:    transport,
+		Compress:     c.Compress,
+		AutoCompress: c.AutoCompress,
+		DataShard:    c.DataShard,
+		Caps:         kcptun.Capabilities,
+	}
+}
+
+// createConn starts a session over KCP with the given parity shards.
+func (cl *client) createConn(parity int) (*tunnel, error) {
+	kcpconn, mtu, err := kcptun.DialKCP(cl.remoteAddr, cl.block, c.DataShard, parity, c.MTU, c.DSCP, c.SockBuf, cl.newObfs())
+	if err != nil {
+		return nil, errors.Wrap(err, "createConn()")
+	}
+	kcpconn.SetStreamMode(true)
+	kcpconn.SetWriteDelay(true)
+	kcpconn.SetNoDelay(c.NoDelay, c.Interval, c.Resend, c.NoCongestion)
+	kcpconn.SetWindowSize(c.SndWnd, c.RcvWnd)
+	kcpconn.SetMtu(mtu)
+	kcpconn.SetACKNoDelay(c.AckNodelay)
+
+	hello := cl.hello(kcptun.TransportKCP)
+	hello.ParityShard = parity
+	hello.MTU = mtu
+	t, reply, err := cl.startSession(kcpconn, hello)
+	if err != nil {
+		return nil, errors.Wrap(err, "createConn()")
+	}
+	t.parity = parity
+
+	if reply.MTU != mtu {
+		kcpconn.SetMtu(reply.MTU)
+	}
+	if reply.ParityShard != parity {
+		cl.setParity(reply.ParityShard)
+	}
+	cl.setAdaptiveFEC(kcptun.HasCap(reply.Caps, kcptun.CapAdaptiveFEC))
+	log.Println("connection:", kcpconn.LocalAddr(), "->", kcpconn.RemoteAddr(), "parity shards:", parity, "mtu:", reply.MTU)
+	return t, nil
+}
+
+// newObfs returns the obfuscation of a new KCP session, nil if disabled.
+func (cl *client) newObfs() *kcptun.Obfs {
+	if c.Obfs == "" {
+		return nil
+	}
+	obfs, _ := kcptun.NewObfs(c.Obfs, c.ObfsLength, cl.obfsKey, kcptun.ObfsMaxLen(c.MTU))
+	return obfs
+}
+
+// createTCPConn starts a session over the fallback transport.
+func (cl *client) createTCPConn() (*tunnel, error) {
+	conn, err := kcptun.DialTCP(cl.remoteAddr, cl.tlsConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "createTCPConn()")
+	}
+	t, _, err := cl.startSession(conn, cl.hello(c.Fallback))
+	if err != nil {
+		return nil, errors.Wrap(err, "createTCPConn()")
+	}
+	log.Println("connection:", conn.LocalAddr(), "->", conn.RemoteAddr(), "over", c.Fallback)
+	return t, nil
+}
+
+// createQUICConn starts a session over QUIC.
+func (cl *client) createQUICConn() (*tunnel, error) {
+	mux, err := kcptun.DialQUIC(cl.remoteAddr, cl.quicTLS, c.DSCP, c.SockBuf)
+	if err != nil {
+		return nil, errors.Wrap(err, "createQUICConn()")
+	}
+	// QUIC streams aren't compressed
+	hello := cl.hello(kcptun.TransportQUIC)
+	hello.Compress = "none"
+	hello.AutoCompress = false
+	t, _, err := cl.start(mux, hello)
+	if err != nil {
+		return nil, errors.Wrap(err, "createQUICConn()")
+	}
+	log.Println("connection:", mux.LocalAddr(), "->", mux.RemoteAddr(), "over quic")
+	return t, nil
+}
+
+// createWSConn starts a session over WebSocket.
+func (cl *client) createWSConn() (*tunnel, error) {
+	conn, err := kcptun.DialWS(cl.wsURL, c.WSHost, cl.tlsConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "createWSConn()")
+	}
+	t, _, err := cl.startSession(conn, cl.hello(c.Transport))
+	if err != nil {
+		return nil, errors.Wrap(err, "createWSConn()")
+	}
+	log.Println("connection:", conn.LocalAddr(), "->", cl.wsURL)
+	return t, nil
+}
+
+// createTransportConn starts a session over the transport of c.Transport.
+func (cl *client) createTransportConn() (*tunnel, error) {
+	switch c.Transport {
+	case kcptun.TransportQUIC:
+		return cl.createQUICConn()
+	case kcptun.TransportWS, kcptun.TransportWSS:
+		return cl.createWSConn()
+	}
+	return cl.createConn(cl.currentParity())
+}
+
+// startSession multiplexes conn with smux and shakes hands with the server,
+// it closes conn on failure.
+func (cl *client) startSession(conn net.Conn, hello *kcptun.Hello) (*tunnel, *kcptun.Hello, error) {
+	// stream multiplex
+	comp := kcptun.NewCompStream(conn, cl.codec, c.AutoCompress)
+	session, err := smux.Client(comp, cl.smuxConfig)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	t, reply, err := cl.start(kcptun.NewSmux(session), hello)
+	if err != nil {
+		return nil, nil, err
+	}
+	if reply.Compress != hello.Compress || reply.AutoCompress != hello.AutoCompress {
+		log.Printf("server only allows compress %s (auto %v)\n", reply.Compress, reply.AutoCompress)
+		codec, _ := kcptun.ParseCodec(reply.Compress)
+		comp.SetCodec(codec, reply.AutoCompress)
+	}
+	return t, reply, nil
+}
+
+// start opens the control stream of session and shakes hands with the
+// server, it closes session on failure.
+func (cl *client) start(session kcptun.Mux, hello *kcptun.Hello) (*tunnel, *kcptun.Hello, error) {
+	// the first stream is the control stream
+	stream, err := session.OpenStream()
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	ctrl := kcptun.NewControl(stream)
+	stream.SetReadDeadline(time.Now().Add(kcptun.HandshakeTimeout))
+	reply, err := cl.handshake(ctrl, hello)
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	stream.SetReadDeadline(time.Time{})
+	return &tunnel{session: session, ctrl: ctrl, transport: hello.Transport}, reply, nil
+}
+
+// handshake sends hello and returns the server's settings for the session.
+func (cl *client) handshake(ctrl *kcptun.Control, hello *kcptun.Hello) (*kcptun.Hello, error) {
+	if err := ctrl.WriteHello(kcptun.CtrlHello, hello); err != nil {
+		return nil, err
+	}
+	reply, err := ctrl.ReadHello(kcptun.CtrlHelloReply)
+	if err != nil {
+		return nil, fmt.Errorf("no handshake from %s over %s: %v, check that it runs a compatible server and gets the traffic",
+			cl.remoteAddr, hello.Transport, err)
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("server %s refused: %s", cl.remoteAddr, reply.Error)
+	}
+	if reply.Version < kcptun.MinProtocolVersion {
+		return nil, fmt.Errorf("server %s speaks protocol version %d, the client needs %d to %d",
+			cl.remoteAddr, reply.Version, kcptun.MinProtocolVersion, kcptun.ProtocolVersion)
+	}
+	if !sameTransport(reply.Transport, hello.Transport) {
+		return nil, fmt.Errorf("server %s got the session over %s, not %s", cl.remoteAddr, reply.Transport, hello.Transport)
+	}
+	return reply, nil
+}
+
+// sameTransport reports whether the server sees the transport the client
+// dialed. A proxy in front of the server may terminate TLS of wss.
+func sameTransport(server, client string) bool {
+	if server == kcptun.TransportWS && client == kcptun.TransportWSS {
+		return true
+	}
+	return server == client
+}
+
+// Policies choosing the session of a new stream.
+const (
+	PolicyLeastLoaded = "least-loaded"
+	PolicyRoundRobin  = "round-robin"
+)
+
+// roundRobin returns the next healthy session.
+func (cl *client) roundRobin() kcptun.Mux {
+	n := uint32(len(cl.muxes))
+	start := atomic.AddUint32(&cl.rr, 1)
+	for i := uint32(0); i < n; i++ {
+		if session := cl.muxes[(start+i)%n].get(); session != nil {
+			return session
 		}
-		kcpconn.SetStreamMode(true)
-		kcpconn.SetWriteDelay(true)
-		kcpconn.SetNoDelay(c.NoDelay, c.Interval, c.Resend, c.NoCongestion)
-		kcpconn.SetWindowSize(c.SndWnd, c.RcvWnd)
-		kcpconn.SetMtu(c.MTU)
-		kcpconn.SetACKNoDelay(c.AckNodelay)
-
-		if err := kcpconn.SetDSCP(c.DSCP); err != nil {
-			log.Println("SetDSCP:", err)
+	}
+	return nil
+}
+
+// leastLoaded returns the healthy session with the lowest cost.
+func (cl *client) leastLoaded() kcptun.Mux {
+	var best kcptun.Mux
+	var bestCost float64
+	for _, m := range cl.muxes {
+		if session, cost := m.cost(); session != nil && (best == nil || cost < bestCost) {
+			best, bestCost = session, cost
 		}
+	}
+	return best
+}
 
-		if err := kcpconn.SetReadBuffer(c.SockBuf); err != nil {
-			log.Println("SetReadBuffer:", err)
+// pick returns a healthy session by c.MuxPolicy, waiting up to waitHealthy
+// for one while all of them are reconnecting.
+func (cl *client) pick() kcptun.Mux {
+	deadline := time.Now().Add(waitHealthy)
+	for {
+		var session kcptun.Mux
+		if c.MuxPolicy == PolicyRoundRobin {
+			session = cl.roundRobin()
+		} else {
+			session = cl.leastLoaded()
 		}
-		if err := kcpconn.SetWriteBuffer(c.SockBuf); err != nil {
-			log.Println("SetWriteBuffer:", err)
+		if session != nil || time.Now().After(deadline) {
+			return session
 		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (cl *client) handle(p1 io.ReadWriteCloser) {
+	session := cl.pick()
+	if session == nil {
+		log.Println("no healthy session to", cl.remoteAddr)
+		p1.Close()
+		return
+	}
+	handleClient(session, p1)
+}
 
-		// stream multiplex
-		var session *smux.Session
+// newTLSConfig verifies the server by c.TLSServerName, or else by the Host
+// header or host, the server's or of the WebSocket URL.
+func newTLSConfig(host string) *tls.Config {
+	conf := &tls.Config{ServerName: c.TLSServerName, InsecureSkipVerify: c.TLSInsecure}
+	if conf.ServerName == "" {
+		conf.ServerName = c.WSHost
+	}
+	if host, _, err := net.SplitHostPort(conf.ServerName); err == nil {
+		conf.ServerName = host
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = host
+	}
+	return conf
+}
 
-		session, err = smux.Client(kcptun.NewCompStream(kcpconn), smuxConfig)
+// ServeClient tunnels every connection accepted on listener to the KCP
+// server at remoteAddr. Closing listener stops it, its sessions are closed
+// once their streams end.
+func ServeClient(listener *net.TCPListener, remoteAddr string) {
+	rand.Seed(int64(time.Now().Nanosecond()))
 
-		if err != nil {
-			return nil, errors.Wrap(err, "createConn()")
-		}
-		log.Println("connection:", kcpconn.LocalAddr(), "->", kcpconn.RemoteAddr())
-		return session, nil
+	if c.MuxPolicy != PolicyLeastLoaded && c.MuxPolicy != PolicyRoundRobin {
+		log.Fatalf("unknown mux policy %s\n", c.MuxPolicy)
+	}
+	codec, err := kcptun.ParseCodec(c.Compress)
+	kcptun.CheckError(err)
+	if c.MinParityShard < 0 || c.MinParityShard > c.MaxParityShard || c.MaxParityShard > kcptun.MaxParity {
+		log.Fatalf("parity shards must be within 0-%d\n", kcptun.MaxParity)
+	}
+	if c.DataShard < 1 {
+		log.Fatalln("data shards must be at least 1")
+	}
+	if c.MTU != 0 {
+		c.MTU = kcptun.ClampMTU(c.MTU)
 	}
 
-	// wait until a connection is ready
-	waitConn := func() *smux.Session {
-		for {
-			if session, err := createConn(); err == nil {
-				return session
-			}
-			time.Sleep(time.Second)
-		}
+	pass := pbkdf2.Key([]byte(c.Key), []byte(c.SALT), 4096, 32, sha1.New)
+	block, _ := kcp.NewAESBlockCrypt(pass)
+	if c.Obfs != "" {
+		_, err := kcptun.NewObfs(c.Obfs, c.ObfsLength, pass, kcptun.ObfsMaxLen(c.MTU))
+		kcptun.CheckError(err)
 	}
 
-	numconn := uint16(c.Conn)
-	muxes := make([]struct {
-		session *smux.Session
-		ttl     time.Time
-	}, numconn)
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.MaxReceiveBuffer = c.SockBuf
+	smuxConfig.KeepAliveInterval = time.Duration(c.KeepAlive) * time.Second
 
-	for k := range muxes {
-		muxes[k].session = waitConn()
-		muxes[k].ttl = time.Now().Add(time.Duration(c.AutoExpire) * time.Second)
+	cl := &client{
+		remoteAddr:  remoteAddr,
+		block:       block,
+		obfsKey:     pass,
+		smuxConfig:  smuxConfig,
+		muxes:       make([]*mux, c.Conn),
+		codec:       codec,
+		parity:      int32(kcptun.ClampParity(c.ParityShard, c.MinParityShard, c.MaxParityShard)),
+		chScavenger: make(chan kcptun.Mux, 128),
+		die:         make(chan struct{}),
+	}
+	if c.WSURL != "" && c.Transport != kcptun.TransportWS && c.Transport != kcptun.TransportWSS {
+		log.Fatalln("websocket url only applies to ws and wss")
+	}
+	host, _, _ := net.SplitHostPort(remoteAddr)
+	switch c.Fallback {
+	case "", kcptun.TransportTCP:
+	case kcptun.TransportTLS:
+		cl.tlsConfig = newTLSConfig(host)
+	default:
+		log.Fatalf("unknown fallback transport %s\n", c.Fallback)
+	}
+	switch c.Transport {
+	case kcptun.TransportKCP:
+	case kcptun.TransportQUIC:
+		cl.quicTLS = newTLSConfig(host)
+	case kcptun.TransportWS, kcptun.TransportWSS:
+		if c.Fallback != "" {
+			log.Fatalln("fallback only applies to kcp and quic")
+		}
+		cl.wsURL = kcptun.WSURL(c.Transport, remoteAddr, c.WSPath)
+		if c.WSURL != "" {
+			u, err := kcptun.ParseWSURL(c.WSURL)
+			kcptun.CheckError(err)
+			if u.Scheme != c.Transport {
+				log.Fatalf("websocket url %s doesn't match transport %s\n", c.WSURL, c.Transport)
+			}
+			cl.wsURL, host = c.WSURL, u.Hostname()
+		}
+		cl.tlsConfig = newTLSConfig(host)
+	default:
+		log.Fatalf("unknown transport %s\n", c.Transport)
+	}
+	var monitors sync.WaitGroup
+	for k := range cl.muxes {
+		cl.muxes[k] = new(mux)
+		monitors.Add(1)
+		go func(m *mux) {
+			defer monitors.Done()
+			cl.monitor(m)
+		}(cl.muxes[k])
+	}
+	if c.MinParityShard < c.MaxParityShard {
+		go cl.tuneFEC()
 	}
 
-	chScavenger := make(chan *smux.Session, 128)
-	go scavenger(chScavenger, c.ScavengeTTL)
+	// the monitors hand sessions to the scavenger until they return
+	drained := make(chan struct{})
+	go scavenger(cl.chScavenger, c.ScavengeTTL, drained)
 	// go kcptun.SnmpLogger(kcptun.SnmpLog, kcptun.SnmpPeriod)
-	rr := uint16(0)
+	atomic.AddInt32(&clients, 1)
+	var tempDelay time.Duration
 	for {
 		p1, err := listener.AcceptTCP()
-		kcptun.CheckError(err)
-
-		idx := rr % numconn
-
-		// do auto expiration && reconnection
-		if muxes[idx].session.IsClosed() || (c.AutoExpire > 0 && time.Now().After(muxes[idx].ttl)) {
-			chScavenger <- muxes[idx].session
-			muxes[idx].session = waitConn()
-			muxes[idx].ttl = time.Now().Add(time.Duration(c.AutoExpire) * time.Second)
+		if err != nil {
+			if netutil.RetryAccept(err, &tempDelay) {
+				continue
+			}
+			if netutil.Closed(err) {
+				// stopped, the sessions drain in the scavenger
+				log.Println("kcp client to", remoteAddr, "stopped")
+				atomic.AddInt32(&clients, -1)
+				close(cl.die)
+				go func() {
+					monitors.Wait()
+					close(drained)
+				}()
+				return
+			}
+			log.Fatalf("%+v\n", err)
 		}
-
-		go handleClient(muxes[idx].session, p1)
-		rr++
+		tempDelay = 0
+		go cl.handle(p1)
 	}
 }
 
 type scavengeSession struct {
-	session *smux.Session
+	session kcptun.Mux
 	ts      time.Time
 }
 
-func scavenger(ch chan *smux.Session, ttl int) {
+// scavenger closes the sessions sent to it once their streams end or ttl
+// passes. After done, closed once nothing sends to ch anymore, it returns as
+// soon as it has none left.
+func scavenger(ch chan kcptun.Mux, ttl int, done chan struct{}) {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 	var sessionList []scavengeSession
@@ -172,6 +500,18 @@ func scavenger(ch chan *smux.Session, ttl int) {
 				}
 			}
 			sessionList = newList
+			if len(sessionList) == 0 && len(ch) == 0 && isClosed(done) {
+				return
+			}
 		}
 	}
 }
+
+func isClosed(die chan struct{}) bool {
+	select {
+	case <-die:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	c "github.com/elvizlai/sskcp/config"
+	"github.com/elvizlai/sskcp/kcptun"
+)
+
+// A session dialed while the client stops is closed, not left to a scavenger
+// that may be gone.
+func TestStopWhileDialing(t *testing.T) {
+	savedTransport, savedInsecure, savedMin, savedMax := c.Transport, c.TLSInsecure, c.MinParityShard, c.MaxParityShard
+	c.Transport, c.TLSInsecure, c.MinParityShard, c.MaxParityShard = kcptun.TransportQUIC, true, 0, 0
+	defer func() {
+		c.Transport, c.TLSInsecure, c.MinParityShard, c.MaxParityShard = savedTransport, savedInsecure, savedMin, savedMax
+	}()
+
+	l, err := kcptun.ListenKCP("127.0.0.1:0", nil, 10, 0, 1<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	serverTLS, err := kcptun.ServerTLSConfig("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ql, err := l.ListenQUIC(serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ql.Close()
+
+	// the server holds its answer to the hello until the client stopped
+	hello := make(chan struct{})
+	answer := make(chan struct{})
+	closed := make(chan struct{})
+	go func() {
+		m, err := ql.Accept()
+		if err != nil {
+			return
+		}
+		s, err := m.AcceptStream()
+		if err != nil {
+			return
+		}
+		ctrl := kcptun.NewControl(s)
+		h, err := ctrl.ReadHello(kcptun.CtrlHello)
+		if err != nil {
+			return
+		}
+		close(hello)
+		<-answer
+		ctrl.WriteHello(kcptun.CtrlHelloReply, &kcptun.Hello{Version: kcptun.ProtocolVersion,
+			Transport: h.Transport, Compress: h.Compress, DataShard: h.DataShard})
+		for {
+			if _, err := m.AcceptStream(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		ServeClient(listener, l.Addr().String())
+		close(stopped)
+	}()
+	select {
+	case <-hello:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no hello from the client")
+	}
+	listener.Close()
+	<-stopped
+	// the scavenger had a tick to find itself without sessions
+	time.Sleep(1500 * time.Millisecond)
+	close(answer)
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("session dialed while stopping left open")
+	}
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+
+	c "github.com/elvizlai/sskcp/config"
+	"github.com/elvizlai/sskcp/kcptun"
+	kcp "github.com/xtaci/kcp-go"
+)
+
+const (
+	fecInterval = 30 * time.Second
+	fecMinSegs  = 1000 // rounds with less traffic tell nothing about the loss
+	fecMargin   = 2    // parity covers this multiple of the measured loss
+	fecCalm     = 4    // rounds in a row wanting less parity before lowering it
+)
+
+// clients counts the running clients of the process, see tuneFEC.
+var clients int32
+
+func (cl *client) currentParity() int {
+	return int(atomic.LoadInt32(&cl.parity))
+}
+
+// setParity takes the parity accepted by the server, sessions with another
+// one are replaced by their monitors.
+func (cl *client) setParity(parity int) {
+	if old := atomic.SwapInt32(&cl.parity, int32(parity)); int(old) != parity {
+		log.Printf("parity shards %d -> %d\n", old, parity)
+	}
+}
+
+func (cl *client) setAdaptiveFEC(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&cl.adaptiveFEC, v)
+}
+
+// wantParity returns the parity shards making up for loss with some margin.
+func wantParity(loss float64) int {
+	parity := int(math.Ceil(fecMargin * loss * float64(c.DataShard)))
+	return kcptun.ClampParity(parity, c.MinParityShard, c.MaxParityShard)
+}
+
+// tuneFEC estimates the loss from kcp.DefaultSnmp and proposes a parity
+// matching it to the server. Upstream only retransmissions are seen, and
+// downstream only what FEC recovered, so the worse of both counts.
+//
+// The counters are shared by all sessions of the process, they can't tell
+// the tunnels to several servers apart. So parity only adapts while the
+// process runs a single tunnel, with more each keeps its current parity.
+//
+// Every change replaces the sessions, so parity is raised at once but only
+// lowered a step after fecCalm rounds in a row asked for less.
+func (cl *client) tuneFEC() {
+	ticker := time.NewTicker(fecInterval)
+	defer ticker.Stop()
+	last := kcp.DefaultSnmp.Copy()
+	calm := 0
+	shared := false
+	for {
+		select {
+		case <-ticker.C:
+		case <-cl.die:
+			return
+		}
+		cur := kcp.DefaultSnmp.Copy()
+		out, retrans := cur.OutSegs-last.OutSegs, cur.RetransSegs-last.RetransSegs
+		in, recovered := cur.InSegs-last.InSegs, cur.FECRecovered-last.FECRecovered
+		reset := cur.OutSegs < last.OutSegs || cur.InSegs < last.InSegs
+		last = cur
+		if n := atomic.LoadInt32(&clients); (n > 1) != shared {
+			if shared = n > 1; shared {
+				log.Printf("adaptive parity paused, the loss of the %d kcp tunnels can't be told apart\n", n)
+			} else {
+				log.Println("adaptive parity resumed")
+			}
+		}
+		if shared {
+			calm = 0
+			continue
+		}
+		if reset || out+in < fecMinSegs || atomic.LoadInt32(&cl.adaptiveFEC) == 0 {
+			continue
+		}
+		var loss float64
+		if out > 0 {
+			loss = float64(retrans) / float64(out)
+		}
+		if in > 0 {
+			loss = math.Max(loss, float64(recovered)/float64(in))
+		}
+
+		parity, want := cl.currentParity(), wantParity(loss)
+		if want < parity {
+			if calm++; calm < fecCalm {
+				continue
+			}
+			want = parity - 1
+		}
+		calm = 0
+		if want == parity {
+			continue
+		}
+		log.Printf("loss %.2f%%, proposing parity shards %d\n", loss*100, want)
+		for _, m := range cl.muxes {
+			if ctrl := m.control(); ctrl != nil {
+				if err := ctrl.WriteMsg(kcptun.CtrlFEC, []byte{byte(want)}); err == nil {
+					break
+				}
+			}
+		}
+	}
+}
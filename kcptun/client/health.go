@@ -0,0 +1,313 @@
+package client
+
+import (
+	"encoding/binary"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	c "github.com/elvizlai/sskcp/config"
+	"github.com/elvizlai/sskcp/kcptun"
+)
+
+const (
+	pingInterval = 5 * time.Second  // between pings on the control stream
+	pingTimeout  = 15 * time.Second // without a pong for this long the session is dead
+	minBackoff   = time.Second      // reconnect delay after a failed session
+	maxBackoff   = time.Minute      // the delay doubles per failure up to this
+	waitHealthy  = 10 * time.Second // a new connection waits this long for a healthy session
+
+	udpRetryInterval = time.Minute // sessions over the fallback transport retry KCP this often
+	udpFailLimit     = 2           // failed sessions over UDP in a row before trying the fallback
+
+	rttGain    = 0.125 // EWMA gains of the smoothed rtt and ping loss
+	lossGain   = 0.2
+	lossWeight = 4 // cost factor of a session losing every ping
+)
+
+// mux is one session to the server. Its monitor replaces the session when it
+// dies or expires, meanwhile it isn't handed out.
+type mux struct {
+	mu       sync.RWMutex
+	session  kcptun.Mux
+	ctrl     *kcptun.Control
+	healthy  bool // answered a ping within pingTimeout
+	lastPong time.Time
+	rtt      time.Duration // smoothed
+	loss     float64       // smoothed ratio of unanswered pings
+	awaiting bool          // a ping is in flight
+}
+
+// cost estimates the delay of a new stream on the healthy session: streams
+// share its bandwidth and lost pings stand for retransmissions. It returns a
+// nil session if the mux isn't healthy.
+func (m *mux) cost() (kcptun.Mux, float64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.healthy || m.session.IsClosed() {
+		return nil, 0
+	}
+	rtt := m.rtt
+	if rtt < time.Millisecond {
+		rtt = time.Millisecond
+	}
+	return m.session, float64(m.session.NumStreams()+1) * float64(rtt) * (1 + lossWeight*m.loss)
+}
+
+// get returns the session if it's healthy, nil otherwise.
+func (m *mux) get() kcptun.Mux {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.healthy || m.session.IsClosed() {
+		return nil
+	}
+	return m.session
+}
+
+// control returns the control stream if the session is healthy, nil
+// otherwise.
+func (m *mux) control() *kcptun.Control {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.healthy {
+		return nil
+	}
+	return m.ctrl
+}
+
+func (m *mux) reset(session kcptun.Mux, ctrl *kcptun.Control) {
+	m.mu.Lock()
+	m.session = session
+	m.ctrl = ctrl
+	m.healthy = false
+	m.lastPong = time.Now()
+	m.rtt = 0
+	m.loss = 0
+	m.awaiting = false
+	m.mu.Unlock()
+}
+
+// ping records a ping sent, the previous one is lost if still unanswered.
+func (m *mux) ping() {
+	m.mu.Lock()
+	if m.awaiting {
+		m.loss += lossGain * (1 - m.loss)
+	}
+	m.awaiting = true
+	m.mu.Unlock()
+}
+
+func (m *mux) pong(rtt time.Duration) {
+	m.mu.Lock()
+	if !m.healthy {
+		log.Println("session ready, rtt", rtt)
+	}
+	m.healthy = true
+	m.lastPong = time.Now()
+	if m.rtt == 0 {
+		m.rtt = rtt
+	} else {
+		m.rtt += time.Duration(rttGain * float64(rtt-m.rtt))
+	}
+	if m.awaiting {
+		m.loss -= lossGain * m.loss
+		m.awaiting = false
+	}
+	m.mu.Unlock()
+}
+
+// unresponsive reports whether the last pong is older than pingTimeout.
+func (m *mux) unresponsive() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return time.Since(m.lastPong) > pingTimeout
+}
+
+// retire stops handing out the session and reports whether it ever worked.
+func (m *mux) retire() (worked bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	worked = m.rtt > 0
+	m.healthy = false
+	return
+}
+
+// jitter spreads d over [d/2, 3d/2), so sessions dropped together don't
+// reconnect in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+// dial starts a session over c.Transport, or over the fallback transport once
+// UDP seems blocked: udpFailLimit sessions in a row failed over UDP while the
+// fallback works. A server that is down for both is just retried.
+func (cl *client) dial() (*tunnel, error) {
+	if c.Fallback != "" && atomic.LoadInt32(&cl.udpBlocked) == 1 {
+		return cl.createTCPConn()
+	}
+	t, err := cl.createTransportConn()
+	if err == nil {
+		atomic.StoreInt32(&cl.udpFails, 0)
+		return t, nil
+	}
+	if c.Fallback == "" || atomic.AddInt32(&cl.udpFails, 1) < udpFailLimit {
+		return nil, err
+	}
+	log.Println(err)
+	t, tcpErr := cl.createTCPConn()
+	if tcpErr != nil {
+		log.Println(tcpErr)
+		return nil, err
+	}
+	log.Println("UDP to", cl.remoteAddr, "seems blocked, falling back to", c.Fallback)
+	atomic.StoreInt32(&cl.udpBlocked, 1)
+	atomic.StoreInt32(&cl.udpFails, 0)
+	return t, nil
+}
+
+// monitor keeps m connected for the life of the client. Sessions that never
+// answered a ping are retried with exponential backoff.
+func (cl *client) monitor(m *mux) {
+	backoff := minBackoff
+	var next *tunnel
+	for {
+		if isClosed(cl.die) {
+			if next != nil {
+				next.session.Close()
+			}
+			return
+		}
+		t, err := next, error(nil)
+		if t == nil {
+			t, err = cl.dial()
+		}
+		next = nil
+		if err == nil && isClosed(cl.die) {
+			// stopped while dialing, no stream has the session yet
+			t.session.Close()
+			return
+		}
+		if err != nil {
+			log.Println(err)
+		} else if worked, upgrade := cl.keepalive(m, t); worked || upgrade != nil {
+			next = upgrade
+			backoff = minBackoff
+			continue
+		}
+		d := jitter(backoff)
+		log.Println("reconnecting to", cl.remoteAddr, "in", d)
+		select {
+		case <-time.After(d):
+		case <-cl.die:
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// keepalive pings the server over the control stream of t until the session
+// dies, expires or its parity is outdated, or the client stops, then hands it
+// to the scavenger, or closes it right away if the client stopped and it has
+// no streams.
+// Sessions over the fallback transport retry UDP every udpRetryInterval and
+// give way to it once it works again. It reports whether the session worked
+// and the tunnel replacing it, if any.
+func (cl *client) keepalive(m *mux, t *tunnel) (bool, *tunnel) {
+	m.reset(t.session, t.ctrl)
+	go func() {
+		for {
+			typ, payload, err := t.ctrl.ReadMsg()
+			if err != nil {
+				return
+			}
+			switch {
+			case typ == kcptun.CtrlPong && len(payload) == 8:
+				sent := int64(binary.BigEndian.Uint64(payload))
+				m.pong(time.Duration(time.Now().UnixNano() - sent))
+			case typ == kcptun.CtrlFEC && len(payload) == 1:
+				cl.setParity(int(payload[0]))
+			}
+		}
+	}()
+
+	ttl := time.Now().Add(time.Duration(c.AutoExpire) * time.Second)
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	ping := make([]byte, 8)
+
+	fallback := t.transport == c.Fallback
+	lastProbe := time.Now()
+	probing := false
+	probes := make(chan *tunnel, 1)
+	var upgrade *tunnel
+loop:
+	for {
+		m.ping()
+		binary.BigEndian.PutUint64(ping, uint64(time.Now().UnixNano()))
+		if err := t.ctrl.WriteMsg(kcptun.CtrlPing, ping); err != nil {
+			log.Println("ping:", err)
+			break
+		}
+		for ticked := false; !ticked; {
+			select {
+			case <-ticker.C:
+				ticked = true
+			case <-cl.die:
+				break loop
+			case upgrade = <-probes:
+				probing = false
+				lastProbe = time.Now()
+				if upgrade != nil {
+					log.Println("UDP to", cl.remoteAddr, "works again, switching back to", c.Transport)
+					atomic.StoreInt32(&cl.udpBlocked, 0)
+					break loop
+				}
+			}
+		}
+		if t.session.IsClosed() {
+			log.Println("session closed")
+			break
+		}
+		if m.unresponsive() {
+			log.Println("session unresponsive for", pingTimeout)
+			break
+		}
+		if c.AutoExpire > 0 && time.Now().After(ttl) {
+			break
+		}
+		if p := cl.currentParity(); t.transport == kcptun.TransportKCP && p != t.parity {
+			log.Println("replacing session for parity shards", p)
+			break
+		}
+		if fallback && !probing && time.Since(lastProbe) >= udpRetryInterval {
+			probing = true
+			go func() {
+				nt, err := cl.createTransportConn()
+				if err != nil {
+					log.Println("UDP still blocked:", err)
+				}
+				probes <- nt
+			}()
+		}
+	}
+	if probing {
+		// the session ended before the probe did
+		go func() {
+			if nt := <-probes; nt != nil {
+				nt.session.Close()
+			}
+		}()
+	}
+
+	worked := m.retire()
+	t.ctrl.Close()
+	if isClosed(cl.die) && t.session.NumStreams() == 0 {
+		t.session.Close()
+	} else {
+		cl.chScavenger <- t.session
+	}
+	return worked, upgrade
+}
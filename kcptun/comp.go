@@ -0,0 +1,247 @@
+package kcptun
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/pkg/errors"
+)
+
+// Compression codecs of a CompStream.
+const (
+	CodecNone = iota
+	CodecSnappy
+	CodecZstd
+	CodecLZ4
+	NumCodecs
+)
+
+var codecNames = [NumCodecs]string{"none", "snappy", "zstd", "lz4"}
+
+// ParseCodec returns the codec named name.
+func ParseCodec(name string) (byte, error) {
+	for i, n := range codecNames {
+		if n == name {
+			return byte(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression %s", name)
+}
+
+// Every write is sent as frames of at most maxChunk bytes, each compressed
+// on its own:
+//
+//	codec(1) raw length(2) length(2) payload(length)
+//
+// so the reader decodes whatever codec the writer picked per frame.
+const (
+	frameHeaderLen = 5
+	maxChunk       = 65535
+	minCompress    = 64 // shorter chunks are sent as they are
+
+	// adaptive mode skips compressing after a frame that saved less than
+	// 1/worthwhile, then twice as many after each further miss
+	worthwhile = 8
+	maxSkip    = 64
+)
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+func initZstd() {
+	zstdEnc, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	zstdDec, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxChunk))
+}
+
+// encode compresses src with codec into dst, which has room for the bound of
+// any codec. It returns nil if the codec didn't make it shorter.
+func (c *CompStream) encode(codec byte, dst, src []byte) []byte {
+	var out []byte
+	switch codec {
+	case CodecSnappy:
+		out = snappy.Encode(dst, src)
+	case CodecZstd:
+		zstdOnce.Do(initZstd)
+		out = zstdEnc.EncodeAll(src, dst[:0])
+	case CodecLZ4:
+		if c.lz4Table == nil {
+			c.lz4Table = make([]int, 1<<16)
+		}
+		n, err := lz4.CompressBlock(src, dst, c.lz4Table)
+		if err != nil || n == 0 {
+			return nil
+		}
+		out = dst[:n]
+	}
+	if len(out) == 0 || len(out) >= len(src) {
+		return nil
+	}
+	return out
+}
+
+func decode(codec byte, dst, src []byte) error {
+	var n int
+	var err error
+	switch codec {
+	case CodecSnappy:
+		if l, err := snappy.DecodedLen(src); err != nil || l != len(dst) {
+			return errors.New("snappy: corrupt frame")
+		}
+		_, err = snappy.Decode(dst, src)
+		n = len(dst)
+	case CodecZstd:
+		zstdOnce.Do(initZstd)
+		var out []byte
+		out, err = zstdDec.DecodeAll(src, dst[:0])
+		n = len(out)
+	case CodecLZ4:
+		n, err = lz4.UncompressBlock(src, dst)
+	default:
+		return fmt.Errorf("unknown codec %d", codec)
+	}
+	if err != nil {
+		return err
+	}
+	if n != len(dst) {
+		return errors.New("frame length mismatch")
+	}
+	return nil
+}
+
+// CompStream compresses a KCP session. Its codec can change at any time,
+// the other end follows frame by frame.
+type CompStream struct {
+	conn net.Conn
+	mode uint32 // codec | adaptive<<8
+
+	// writer, used by a single goroutine
+	wbuf     []byte
+	skip     int
+	misses   uint
+	lz4Table []int
+
+	// reader
+	rhdr [frameHeaderLen]byte
+	rbuf []byte
+	raw  []byte
+	data []byte // decoded, not read yet
+}
+
+func NewCompStream(conn net.Conn, codec byte, adaptive bool) *CompStream {
+	c := &CompStream{
+		conn: conn,
+		wbuf: make([]byte, frameHeaderLen+maxEncodedLen),
+		rbuf: make([]byte, maxChunk),
+		raw:  make([]byte, maxChunk),
+	}
+	c.SetCodec(codec, adaptive)
+	return c
+}
+
+// maxEncodedLen is the worst case output of any codec for maxChunk bytes.
+var maxEncodedLen = snappy.MaxEncodedLen(maxChunk) + lz4.CompressBlockBound(maxChunk)
+
+// SetCodec changes the codec of the frames written from now on. Adaptive
+// only compresses while it pays off.
+func (c *CompStream) SetCodec(codec byte, adaptive bool) {
+	mode := uint32(codec)
+	if adaptive {
+		mode |= 1 << 8
+	}
+	atomic.StoreUint32(&c.mode, mode)
+}
+
+// Codec returns the codec written and whether it's adaptive.
+func (c *CompStream) Codec() (byte, bool) {
+	mode := atomic.LoadUint32(&c.mode)
+	return byte(mode), mode>>8 != 0
+}
+
+func (c *CompStream) Read(p []byte) (n int, err error) {
+	for len(c.data) == 0 {
+		if _, err = io.ReadFull(c.conn, c.rhdr[:]); err != nil {
+			return 0, err
+		}
+		codec := c.rhdr[0]
+		rawLen := int(binary.BigEndian.Uint16(c.rhdr[1:]))
+		frameLen := int(binary.BigEndian.Uint16(c.rhdr[3:]))
+		if _, err = io.ReadFull(c.conn, c.rbuf[:frameLen]); err != nil {
+			return 0, err
+		}
+		if codec == CodecNone {
+			if rawLen != frameLen {
+				return 0, errors.New("frame length mismatch")
+			}
+			c.data = c.rbuf[:frameLen]
+			break
+		}
+		if err = decode(codec, c.raw[:rawLen], c.rbuf[:frameLen]); err != nil {
+			return 0, errors.Wrap(err, "CompStream.Read()")
+		}
+		c.data = c.raw[:rawLen]
+	}
+	n = copy(p, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func (c *CompStream) Write(p []byte) (n int, err error) {
+	codec, adaptive := c.Codec()
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		if err = c.writeFrame(codec, adaptive, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (c *CompStream) writeFrame(codec byte, adaptive bool, chunk []byte) error {
+	var out []byte
+	if codec != CodecNone && len(chunk) >= minCompress {
+		if adaptive && c.skip > 0 {
+			c.skip--
+		} else {
+			out = c.encode(codec, c.wbuf[frameHeaderLen:], chunk)
+			if out != nil && len(out) > len(chunk)-len(chunk)/worthwhile {
+				out = nil
+			}
+			if out == nil && adaptive {
+				c.skip = 1 << c.misses
+				if c.skip < maxSkip {
+					c.misses++
+				}
+			} else {
+				c.misses = 0
+			}
+		}
+	}
+	if out == nil {
+		codec = CodecNone
+		out = append(c.wbuf[:frameHeaderLen], chunk...)[frameHeaderLen:]
+	}
+	c.wbuf[0] = codec
+	binary.BigEndian.PutUint16(c.wbuf[1:], uint16(len(chunk)))
+	binary.BigEndian.PutUint16(c.wbuf[3:], uint16(len(out)))
+	_, err := c.conn.Write(c.wbuf[:frameHeaderLen+len(out)])
+	return err
+}
+
+func (c *CompStream) Close() error {
+	return c.conn.Close()
+}
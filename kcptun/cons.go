@@ -4,12 +4,10 @@ import (
 	"encoding/csv"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"sync"
 	"time"
 
-	"github.com/golang/snappy"
 	kcp "github.com/xtaci/kcp-go"
 )
 
@@ -23,34 +21,6 @@ func init() {
 	}
 }
 
-type compStream struct {
-	conn net.Conn
-	w    *snappy.Writer
-	r    *snappy.Reader
-}
-
-func (c *compStream) Read(p []byte) (n int, err error) {
-	return c.r.Read(p)
-}
-
-func (c *compStream) Write(p []byte) (n int, err error) {
-	n, err = c.w.Write(p)
-	err = c.w.Flush()
-	return n, err
-}
-
-func (c *compStream) Close() error {
-	return c.conn.Close()
-}
-
-func NewCompStream(conn net.Conn) *compStream {
-	c := new(compStream)
-	c.conn = conn
-	c.w = snappy.NewBufferedWriter(conn)
-	c.r = snappy.NewReader(conn)
-	return c
-}
-
 func CheckError(err error) {
 	if err != nil {
 		log.Fatalf("%+v\n", err)
@@ -0,0 +1,71 @@
+package kcptun
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// The first stream of every smux session is a control stream between the
+// KCP client and server, carrying short typed messages:
+//
+//	type(1) length(2) payload(length)
+//
+// All other streams carry tunneled connections. Message types keep their
+// numbers, new ones get the next free one. 4 and 5 carried MTU and
+// compression changes, settled by the Hello now, and stay unused.
+const (
+	CtrlPing       = 1 // client -> server, payload echoed back
+	CtrlPong       = 2 // server -> client
+	CtrlFEC        = 3 // parity shards, proposed by the client, accepted or imposed by the server
+	CtrlHello      = 6 // client -> server, JSON Hello, the first message
+	CtrlHelloReply = 7 // server -> client, JSON Hello
+)
+
+const ctrlHeaderLen = 3
+
+var (
+	ErrCtrlMsgTooLong = errors.New("control message too long")
+	ErrNoHello        = errors.New("control stream didn't start with a hello, protocol mismatch")
+)
+
+// Control is the control stream of a session. Concurrent writes are
+// serialized, reads must come from a single goroutine.
+type Control struct {
+	conn io.ReadWriteCloser
+	wmu  sync.Mutex
+	hdr  [ctrlHeaderLen]byte
+}
+
+func NewControl(conn io.ReadWriteCloser) *Control {
+	return &Control{conn: conn}
+}
+
+func (c *Control) WriteMsg(typ byte, payload []byte) error {
+	if len(payload) > 0xffff {
+		return ErrCtrlMsgTooLong
+	}
+	buf := make([]byte, ctrlHeaderLen+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(payload)))
+	copy(buf[ctrlHeaderLen:], payload)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (c *Control) ReadMsg() (typ byte, payload []byte, err error) {
+	if _, err = io.ReadFull(c.conn, c.hdr[:]); err != nil {
+		return
+	}
+	typ = c.hdr[0]
+	payload = make([]byte, binary.BigEndian.Uint16(c.hdr[1:]))
+	_, err = io.ReadFull(c.conn, payload)
+	return
+}
+
+func (c *Control) Close() error {
+	return c.conn.Close()
+}
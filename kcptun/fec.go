@@ -0,0 +1,306 @@
+package kcptun
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+	"golang.org/x/net/ipv4"
+)
+
+// The FEC shards of a kcp-go session are fixed once it's created, and a
+// listener decodes all of its sessions with the same shards. So every UDP
+// packet starts with the parity shard count of its session, the server
+// demultiplexes packets to one listener per parity, and the client changes
+// parity by replacing its sessions. Obfuscation hides the prefix, see Obfs.
+
+// MaxParity bounds the parity accepted on the wire.
+const MaxParity = 16
+
+// PortOffset is added to a shadowsocks port for the port of its KCP tunnel.
+const PortOffset = 10000
+
+const fecQueueLen = 1024
+
+var errClosed = errors.New("use of closed connection")
+
+// parityConn prefixes the packets of one session with its parity, or
+// obfuscates them with obfs.
+type parityConn struct {
+	net.PacketConn
+	parity byte
+	obfs   *Obfs
+}
+
+func (c *parityConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	var buf []byte
+	if c.obfs != nil {
+		buf = c.obfs.Seal(c.parity, b)
+	} else {
+		buf = make([]byte, len(b)+1)
+		buf[0] = c.parity
+		copy(buf[1:], b)
+	}
+	if _, err := c.PacketConn.WriteTo(buf, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *parityConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return 0, addr, err
+		}
+		if c.obfs != nil {
+			if parity, packet, ok := c.obfs.Open(b[:n]); ok && parity == c.parity {
+				return copy(b, packet), addr, nil
+			}
+		} else if n > 0 && b[0] == c.parity {
+			return copy(b, b[1:n]), addr, nil
+		}
+	}
+}
+
+func setSockOpts(conn *net.UDPConn, dscp, sockbuf int) {
+	if err := ipv4.NewConn(conn).SetTOS(dscp << 2); err != nil {
+		log.Println("SetDSCP:", err)
+	}
+	if err := conn.SetReadBuffer(sockbuf); err != nil {
+		log.Println("SetReadBuffer:", err)
+	}
+	if err := conn.SetWriteBuffer(sockbuf); err != nil {
+		log.Println("SetWriteBuffer:", err)
+	}
+}
+
+// DialKCP connects to a KCP server on its own UDP socket with the given
+// parity shards, obfuscated by obfs if not nil. With mtu 0 the path MTU is
+// probed first, falling back to DefaultMTU. It returns the MTU to use for the
+// session.
+func DialKCP(raddr string, block kcp.BlockCrypt, dataShards, parityShards, mtu, dscp, sockbuf int, obfs *Obfs) (*kcp.UDPSession, int, error) {
+	if parityShards < 0 || parityShards > MaxParity {
+		return nil, 0, errors.New("parity shards out of range")
+	}
+	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		return nil, 0, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	setSockOpts(conn, dscp, sockbuf)
+	if obfs != nil {
+		// probes would stand out, obfuscated packets keep to the UDP
+		// length of unobfuscated ones
+		mtu = obfs.maxLen - obfs.Overhead()
+	} else {
+		mtu = probeOrDefault(conn, udpaddr, mtu)
+	}
+	sess, err := kcp.NewConn(raddr, block, dataShards, parityShards, &parityConn{conn, byte(parityShards), obfs})
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	return sess, mtu, nil
+}
+
+// ClampParity limits parity to [min, max].
+func ClampParity(parity, min, max int) int {
+	if parity < min {
+		return min
+	}
+	if parity > max {
+		return max
+	}
+	return parity
+}
+
+type packet struct {
+	data []byte
+	addr net.Addr
+}
+
+// parityPipe is the PacketConn of the listener for one parity.
+type parityPipe struct {
+	l      *Listener
+	parity byte
+	ch     chan packet
+}
+
+func (p *parityPipe) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-p.ch:
+		return copy(b, pkt.data), pkt.addr, nil
+	case <-p.l.die:
+		return 0, nil, errClosed
+	}
+}
+
+func (p *parityPipe) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return (&parityConn{p.l.conn, p.parity, p.l.obfs}).WriteTo(b, addr)
+}
+
+// the listener closes the socket
+func (p *parityPipe) Close() error                       { return nil }
+func (p *parityPipe) LocalAddr() net.Addr                { return p.l.conn.LocalAddr() }
+func (p *parityPipe) SetDeadline(t time.Time) error      { return nil }
+func (p *parityPipe) SetReadDeadline(t time.Time) error  { return nil }
+func (p *parityPipe) SetWriteDeadline(t time.Time) error { return nil }
+
+// Listener accepts KCP sessions of any parity up to MaxParity on one UDP
+// socket.
+type Listener struct {
+	conn       *net.UDPConn
+	block      kcp.BlockCrypt
+	dataShards int
+	obfs       *Obfs
+
+	mu    sync.Mutex
+	pipes [MaxParity + 1]*parityPipe
+	quic  *quicPipe // set by ListenQUIC
+
+	accepts chan *Session
+	die     chan struct{}
+	once    sync.Once
+}
+
+// Session is an accepted KCP session and its parity shards.
+type Session struct {
+	*kcp.UDPSession
+	Parity int
+}
+
+// ListenKCP accepts KCP sessions on laddr, obfuscated by obfs if not nil.
+func ListenKCP(laddr string, block kcp.BlockCrypt, dataShards, dscp, sockbuf int, obfs *Obfs) (*Listener, error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpaddr)
+	if err != nil {
+		return nil, err
+	}
+	setSockOpts(conn, dscp, sockbuf)
+	l := &Listener{
+		conn:       conn,
+		block:      block,
+		dataShards: dataShards,
+		obfs:       obfs,
+		accepts:    make(chan *Session, 128),
+		die:        make(chan struct{}),
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+func (l *Listener) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			l.Close()
+			return
+		}
+		if n >= mtuProbeHdrLen && buf[0] == mtuProbe && l.obfs == nil {
+			l.conn.WriteTo(mtuReply(buf[:n]), addr)
+			continue
+		}
+		if n > 0 && buf[0]&quicFixedBit != 0 {
+			l.mu.Lock()
+			q := l.quic
+			l.mu.Unlock()
+			if q != nil {
+				l.deliver(q.ch, buf[:n], addr)
+			}
+			continue
+		}
+		parity, packet := byte(0), buf[:n]
+		if l.obfs != nil {
+			var ok bool
+			if parity, packet, ok = l.obfs.Open(packet); !ok {
+				continue
+			}
+		} else {
+			if n < 1 || buf[0] > MaxParity {
+				continue
+			}
+			parity, packet = buf[0], buf[1:n]
+		}
+		p := l.pipe(parity)
+		if p == nil {
+			continue
+		}
+		l.deliver(p.ch, packet, addr)
+	}
+}
+
+func (l *Listener) deliver(ch chan packet, b []byte, addr net.Addr) {
+	data := make([]byte, len(b))
+	copy(data, b)
+	select {
+	case ch <- packet{data, addr}:
+	default: // full, drop like the network would
+	}
+}
+
+// pipe returns the pipe of a parity, starting its listener on first use.
+func (l *Listener) pipe(parity byte) *parityPipe {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if p := l.pipes[parity]; p != nil {
+		return p
+	}
+	p := &parityPipe{l, parity, make(chan packet, fecQueueLen)}
+	lis, err := kcp.ServeConn(l.block, l.dataShards, int(parity), p)
+	if err != nil {
+		log.Println("listen parity", parity, err)
+		return nil
+	}
+	l.pipes[parity] = p
+	go func() {
+		<-l.die
+		lis.Close()
+	}()
+	go func() {
+		for {
+			conn, err := lis.AcceptKCP()
+			if err != nil {
+				return
+			}
+			select {
+			case l.accepts <- &Session{conn, int(parity)}:
+			case <-l.die:
+				conn.Close()
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (l *Listener) AcceptKCP() (*Session, error) {
+	select {
+	case s := <-l.accepts:
+		return s, nil
+	case <-l.die:
+		return nil, errClosed
+	}
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.die)
+		l.conn.Close()
+	})
+	return nil
+}
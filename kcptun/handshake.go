@@ -0,0 +1,82 @@
+package kcptun
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ProtocolVersion of the tunnel, servers accept clients speaking
+// MinProtocolVersion and later.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// Optional features, used when both ends have them.
+const CapAdaptiveFEC = "adaptive-fec" // CtrlFEC proposals
+
+var Capabilities = []string{CapAdaptiveFEC}
+
+// HandshakeTimeout bounds the wait for the other end's Hello.
+const HandshakeTimeout = 10 * time.Second
+
+// Hello starts the control stream. The client sends its settings, the server
+// answers with the ones in effect for the session, or an error. Windows
+// aren't part of it, KCP advertises the receive window in every segment and
+// never sends beyond it. Only the parity shards may change later on, with
+// CtrlFEC; a different MTU or compression takes a new session.
+type Hello struct {
+	Version      int      `json:"version"`
+	Transport    string   `json:"transport"`
+	Compress     string   `json:"compress"`
+	AutoCompress bool     `json:"auto_compress"`
+	DataShard    int      `json:"data_shard"`
+	ParityShard  int      `json:"parity_shard"`
+	MTU          int      `json:"mtu"`
+	Caps         []string `json:"caps,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+func (c *Control) WriteHello(typ byte, h *Hello) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return c.WriteMsg(typ, b)
+}
+
+// ReadHello reads a message that must be a Hello of type typ.
+func (c *Control) ReadHello(typ byte) (*Hello, error) {
+	t, payload, err := c.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if t != typ {
+		return nil, ErrNoHello
+	}
+	h := new(Hello)
+	if err := json.Unmarshal(payload, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// CommonCaps returns the capabilities in both a and b.
+func CommonCaps(a, b []string) []string {
+	var common []string
+	for _, x := range a {
+		if HasCap(b, x) {
+			common = append(common, x)
+		}
+	}
+	return common
+}
+
+func HasCap(caps []string, cap string) bool {
+	for _, c := range caps {
+		if c == cap {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package kcptun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MTUs here are of the KCP session, its UDP packets are a byte longer for
+// the parity prefix.
+const (
+	MinMTU = 547  // in the smallest IPv4 datagram every host accepts
+	MaxMTU = 1471 // in a 1500 bytes ethernet frame
+
+	DefaultMTU = 1350 // until discovered, or if discovery fails
+)
+
+// MTU probes are UDP packets with this prefix instead of a parity, padded to
+// the size to test. The server answers each with its nonce and size.
+const (
+	mtuProbe        = 0xff
+	mtuProbeHdrLen  = 1 + 4 // prefix, nonce
+	mtuReplyLen     = mtuProbeHdrLen + 2
+	mtuProbeTries   = 2
+	mtuProbeTimeout = 300 * time.Millisecond
+	mtuCacheTTL     = 10 * time.Minute // paths change, probe again after
+)
+
+// probedMTUs caches the path MTU by server address, sessions replaced or
+// reconnected don't probe again.
+var probedMTUs = struct {
+	sync.Mutex
+	m map[string]probedMTU
+}{m: make(map[string]probedMTU)}
+
+type probedMTU struct {
+	mtu int
+	at  time.Time
+}
+
+// ClampMTU limits mtu to [MinMTU, MaxMTU].
+func ClampMTU(mtu int) int {
+	if mtu < MinMTU {
+		return MinMTU
+	}
+	if mtu > MaxMTU {
+		return MaxMTU
+	}
+	return mtu
+}
+
+// mtuReply answers a probe received by a listener.
+func mtuReply(probe []byte) []byte {
+	reply := make([]byte, mtuReplyLen)
+	copy(reply, probe[:mtuProbeHdrLen])
+	binary.BigEndian.PutUint16(reply[mtuProbeHdrLen:], uint16(len(probe)))
+	return reply
+}
+
+// probeSize reports whether a packet for a session with the given MTU
+// reaches raddr unfragmented.
+func probeSize(conn *net.UDPConn, raddr net.Addr, mtu int) bool {
+	probe := make([]byte, mtu+1)
+	probe[0] = mtuProbe
+	if _, err := rand.Read(probe[1:mtuProbeHdrLen]); err != nil {
+		return false
+	}
+	reply := make([]byte, 64)
+	for i := 0; i < mtuProbeTries; i++ {
+		if _, err := conn.WriteTo(probe, raddr); err != nil {
+			// EMSGSIZE, larger than the local link
+			return false
+		}
+		conn.SetReadDeadline(time.Now().Add(mtuProbeTimeout))
+		for {
+			n, _, err := conn.ReadFrom(reply)
+			if err != nil {
+				break
+			}
+			if n == mtuReplyLen && string(reply[:mtuProbeHdrLen]) == string(probe[:mtuProbeHdrLen]) &&
+				int(binary.BigEndian.Uint16(reply[mtuProbeHdrLen:])) == len(probe) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ProbeMTU finds the largest MTU whose packets reach the KCP server at raddr
+// with the don't fragment bit set, by binary search between MinMTU and
+// MaxMTU. It returns 0 if the server doesn't answer at all.
+func ProbeMTU(conn *net.UDPConn, raddr net.Addr) (int, error) {
+	if err := setDontFragment(conn, true); err != nil {
+		return 0, errors.Wrap(err, "ProbeMTU()")
+	}
+	defer func() {
+		setDontFragment(conn, false)
+		conn.SetReadDeadline(time.Time{})
+	}()
+
+	lo, hi := MinMTU, MaxMTU
+	if !probeSize(conn, raddr, lo) {
+		return 0, nil
+	}
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if probeSize(conn, raddr, mid) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo, nil
+}
+
+// probeOrDefault returns mtu if set, otherwise the probed one, or DefaultMTU
+// if probing fails. Probe results are cached for mtuCacheTTL.
+func probeOrDefault(conn *net.UDPConn, raddr net.Addr, mtu int) int {
+	if mtu > 0 {
+		return mtu
+	}
+	key := raddr.String()
+	probedMTUs.Lock()
+	cached, ok := probedMTUs.m[key]
+	probedMTUs.Unlock()
+	if ok && time.Since(cached.at) < mtuCacheTTL {
+		return cached.mtu
+	}
+
+	probed, err := ProbeMTU(conn, raddr)
+	switch {
+	case err != nil:
+		log.Println(err)
+	case probed == 0:
+		log.Println("no answer to mtu probes from", raddr)
+	default:
+		log.Println("path mtu to", raddr, "is", probed)
+		probedMTUs.Lock()
+		probedMTUs.m[key] = probedMTU{probed, time.Now()}
+		probedMTUs.Unlock()
+		return probed
+	}
+	return DefaultMTU
+}
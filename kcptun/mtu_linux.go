@@ -0,0 +1,36 @@
+//go:build linux
+// +build linux
+
+package kcptun
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDontFragment sets the DF bit on the packets of conn, ignoring the
+// kernel's path MTU cache so probes really go out. Off restores the default.
+func setDontFragment(conn *net.UDPConn, on bool) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	v4, v6 := syscall.IP_PMTUDISC_WANT, syscall.IPV6_PMTUDISC_WANT
+	if on {
+		v4, v6 = syscall.IP_PMTUDISC_PROBE, syscall.IPV6_PMTUDISC_PROBE
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if conn.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, v4)
+			return
+		}
+		// dual stack sockets send IPv4 too
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, v6)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, v4)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package kcptun
+
+import (
+	"errors"
+	"net"
+)
+
+func setDontFragment(conn *net.UDPConn, on bool) error {
+	return errors.New("path mtu discovery is only supported on linux")
+}
@@ -0,0 +1,49 @@
+package kcptun
+
+import (
+	"io"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// Stream is a tunneled connection, or the control stream of a Mux.
+type Stream interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+}
+
+// Mux carries the streams of a tunnel: an smux session over KCP or the
+// fallback transport, or a QUIC connection.
+type Mux interface {
+	OpenStream() (Stream, error)
+	AcceptStream() (Stream, error)
+	NumStreams() int
+	IsClosed() bool
+	Close() error
+}
+
+type smuxMux struct {
+	*smux.Session
+}
+
+// NewSmux returns the Mux of an smux session.
+func NewSmux(s *smux.Session) Mux {
+	return smuxMux{s}
+}
+
+func (m smuxMux) OpenStream() (Stream, error) {
+	s, err := m.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (m smuxMux) AcceptStream() (Stream, error) {
+	s, err := m.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,251 @@
+package kcptun
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Obfuscated KCP packets hide the parity prefix and the packet sizes:
+//
+//	header | nonce(4) | parity(1) length(2) | packet(length) | padding
+//
+// The header is fake, of DTLS or RTP (WebRTC media) records, or none. The
+// parity and length are masked by a hash of the key and nonce, and random
+// padding brings the UDP packet to a length drawn from a LengthDist. Both ends
+// need the same settings, packets that don't fit them are dropped.
+
+// Fake headers of obfuscated packets.
+const (
+	ObfsPlain  = "plain"
+	ObfsDTLS   = "dtls"
+	ObfsWebRTC = "webrtc"
+)
+
+const (
+	obfsNonceLen = 4
+	obfsMetaLen  = obfsNonceLen + 3
+
+	dtlsHeaderLen = 13
+	rtpHeaderLen  = 12
+	rtpClockRate  = 90000 // of video
+)
+
+// LengthDist draws the length of a UDP packet holding n bytes.
+type LengthDist interface {
+	Length(n int) int
+}
+
+type noPadding struct{}
+
+func (noPadding) Length(n int) int { return n }
+
+// randomPadding adds 0 to max bytes.
+type randomPadding struct{ max int }
+
+func (d randomPadding) Length(n int) int { return n + rand.Intn(d.max+1) }
+
+// fixedLength pads packets to at least size.
+type fixedLength struct{ size int }
+
+func (d fixedLength) Length(n int) int { return d.size }
+
+// uniformLength pads to a length uniform in [min, max].
+type uniformLength struct{ min, max int }
+
+func (d uniformLength) Length(n int) int { return d.min + rand.Intn(d.max-d.min+1) }
+
+// normalLength pads to a normally distributed length.
+type normalLength struct{ mean, stddev float64 }
+
+func (d normalLength) Length(n int) int { return int(rand.NormFloat64()*d.stddev + d.mean) }
+
+// ParseLengthDist parses a length distribution: "none", "random:MAX" adding
+// up to MAX bytes, "fixed:SIZE", "uniform:MIN-MAX" or "normal:MEAN,STDDEV".
+// Packets are never shortened.
+func ParseLengthDist(s string) (LengthDist, error) {
+	name, args := s, ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		name, args = s[:i], s[i+1:]
+	}
+	ints := func(sep string, want int) ([]int, bool) {
+		fields := strings.Split(args, sep)
+		if len(fields) != want {
+			return nil, false
+		}
+		v := make([]int, want)
+		for i, f := range fields {
+			n, err := strconv.Atoi(strings.TrimSpace(f))
+			if err != nil || n < 0 || n > 0xffff {
+				return nil, false
+			}
+			v[i] = n
+		}
+		return v, true
+	}
+	switch name {
+	case "", "none":
+		return noPadding{}, nil
+	case "random":
+		if v, ok := ints(",", 1); ok {
+			return randomPadding{v[0]}, nil
+		}
+	case "fixed":
+		if v, ok := ints(",", 1); ok {
+			return fixedLength{v[0]}, nil
+		}
+	case "uniform":
+		if v, ok := ints("-", 2); ok && v[0] <= v[1] {
+			return uniformLength{v[0], v[1]}, nil
+		}
+	case "normal":
+		if v, ok := ints(",", 2); ok {
+			return normalLength{float64(v[0]), float64(v[1])}, nil
+		}
+	}
+	return nil, fmt.Errorf("bad packet length distribution %q", s)
+}
+
+// ObfsMaxLen is the UDP length of unobfuscated packets of sessions with mtu,
+// 0 for DefaultMTU, which obfuscated ones are padded up to.
+func ObfsMaxLen(mtu int) int {
+	if mtu == 0 {
+		mtu = DefaultMTU
+	}
+	return ClampMTU(mtu) + 1
+}
+
+// Obfs obfuscates the packets of one socket.
+type Obfs struct {
+	header string
+	length LengthDist
+	key    []byte
+	maxLen int // padding stops here
+
+	seq   uint64
+	ssrc  uint32
+	ts    uint32
+	start time.Time
+}
+
+// NewObfs obfuscates with the given fake header and length distribution,
+// padding UDP packets up to maxLen bytes.
+func NewObfs(header, length string, key []byte, maxLen int) (*Obfs, error) {
+	switch header {
+	case ObfsPlain, ObfsDTLS, ObfsWebRTC:
+	default:
+		return nil, fmt.Errorf("unknown obfuscation %s", header)
+	}
+	dist, err := ParseLengthDist(length)
+	if err != nil {
+		return nil, err
+	}
+	return &Obfs{
+		header: header,
+		length: dist,
+		key:    key,
+		maxLen: maxLen,
+		ssrc:   rand.Uint32(),
+		ts:     rand.Uint32(),
+		start:  time.Now(),
+	}, nil
+}
+
+func (o *Obfs) headerLen() int {
+	switch o.header {
+	case ObfsDTLS:
+		return dtlsHeaderLen
+	case ObfsWebRTC:
+		return rtpHeaderLen
+	}
+	return 0
+}
+
+// Overhead is the length an obfuscated packet adds at least.
+func (o *Obfs) Overhead() int {
+	return o.headerLen() + obfsMetaLen
+}
+
+func (o *Obfs) mask(nonce []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(o.key)
+	h.Write(nonce)
+	var m [sha256.Size]byte
+	h.Sum(m[:0])
+	return m
+}
+
+// Seal obfuscates a KCP packet of a session with the given parity.
+func (o *Obfs) Seal(parity byte, packet []byte) []byte {
+	hl := o.headerLen()
+	n := hl + obfsMetaLen + len(packet)
+	total := o.length.Length(n)
+	if total > o.maxLen {
+		total = o.maxLen
+	}
+	if total < n {
+		total = n
+	}
+	buf := make([]byte, total)
+
+	seq := atomic.AddUint64(&o.seq, 1)
+	switch o.header {
+	case ObfsDTLS:
+		// application data, DTLS 1.2, epoch 1
+		buf[0], buf[1], buf[2] = 0x17, 0xfe, 0xfd
+		binary.BigEndian.PutUint64(buf[3:], 1<<48|seq&(1<<48-1))
+		binary.BigEndian.PutUint16(buf[11:], uint16(total-hl))
+	case ObfsWebRTC:
+		// RTP version 2, dynamic payload type of video
+		buf[0], buf[1] = 0x80, 96
+		binary.BigEndian.PutUint16(buf[2:], uint16(seq))
+		binary.BigEndian.PutUint32(buf[4:], o.ts+uint32(time.Since(o.start)/(time.Second/rtpClockRate)))
+		binary.BigEndian.PutUint32(buf[8:], o.ssrc)
+	}
+
+	meta := buf[hl:]
+	rand.Read(meta[:obfsNonceLen])
+	if hl == 0 {
+		// apart from QUIC and MTU probes
+		meta[0] &^= quicFixedBit
+	}
+	m := o.mask(meta[:obfsNonceLen])
+	meta[obfsNonceLen] = parity ^ m[0]
+	meta[obfsNonceLen+1] = byte(len(packet)>>8) ^ m[1]
+	meta[obfsNonceLen+2] = byte(len(packet)) ^ m[2]
+	copy(buf[n-len(packet):], packet)
+	rand.Read(buf[n:])
+	return buf
+}
+
+// Open returns the parity and KCP packet of an obfuscated packet, ok is false
+// if it isn't one.
+func (o *Obfs) Open(b []byte) (parity byte, packet []byte, ok bool) {
+	hl := o.headerLen()
+	if len(b) < hl+obfsMetaLen {
+		return 0, nil, false
+	}
+	switch o.header {
+	case ObfsDTLS:
+		if b[0] != 0x17 || b[1] != 0xfe || b[2] != 0xfd || int(binary.BigEndian.Uint16(b[11:])) != len(b)-hl {
+			return 0, nil, false
+		}
+	case ObfsWebRTC:
+		if b[0] != 0x80 || b[1] != 96 {
+			return 0, nil, false
+		}
+	}
+	meta := b[hl:]
+	m := o.mask(meta[:obfsNonceLen])
+	parity = meta[obfsNonceLen] ^ m[0]
+	length := int(meta[obfsNonceLen+1]^m[1])<<8 | int(meta[obfsNonceLen+2]^m[2])
+	if parity > MaxParity || length > len(meta)-obfsMetaLen {
+		return 0, nil, false
+	}
+	return parity, meta[obfsMetaLen : obfsMetaLen+length], true
+}
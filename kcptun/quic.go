@@ -0,0 +1,259 @@
+package kcptun
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUIC replaces KCP and smux as the transport of a tunnel: every tunneled
+// connection is a QUIC stream, the first one is the control stream as over
+// smux. QUIC has its own congestion control and TLS 1.3, so FEC, MTU and
+// compression don't apply. The server takes QUIC packets on the UDP socket
+// of its KCP Listener: their first byte has the fixed bit set, which the
+// parity prefix of KCP packets never has.
+
+const (
+	quicALPN       = "sskcp"
+	quicFixedBit   = 0x40
+	maxQUICStreams = 4096
+)
+
+var errDeadline = errors.New("read deadline exceeded")
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: HandshakeTimeout,
+		MaxIncomingStreams:   maxQUICStreams,
+	}
+}
+
+func withALPN(tlsConfig *tls.Config) *tls.Config {
+	conf := tlsConfig.Clone()
+	conf.NextProtos = []string{quicALPN}
+	return conf
+}
+
+// QUICMux is the Mux of a QUIC connection.
+type QUICMux struct {
+	conn    quic.Connection
+	streams int32
+}
+
+func (m *QUICMux) OpenStream() (Stream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+	defer cancel()
+	s, err := m.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.track(s), nil
+}
+
+func (m *QUICMux) AcceptStream() (Stream, error) {
+	s, err := m.conn.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return m.track(s), nil
+}
+
+func (m *QUICMux) track(s quic.Stream) Stream {
+	atomic.AddInt32(&m.streams, 1)
+	return &quicStream{Stream: s, m: m}
+}
+
+func (m *QUICMux) NumStreams() int {
+	return int(atomic.LoadInt32(&m.streams))
+}
+
+func (m *QUICMux) IsClosed() bool {
+	select {
+	case <-m.conn.Context().Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *QUICMux) Close() error {
+	return m.conn.CloseWithError(0, "")
+}
+
+func (m *QUICMux) LocalAddr() net.Addr  { return m.conn.LocalAddr() }
+func (m *QUICMux) RemoteAddr() net.Addr { return m.conn.RemoteAddr() }
+
+type quicStream struct {
+	quic.Stream
+	m    *QUICMux
+	once sync.Once
+}
+
+// Close ends both directions like an smux stream, Close of a QUIC stream
+// only ends writing.
+func (s *quicStream) Close() error {
+	var err error
+	s.once.Do(func() {
+		s.CancelRead(0)
+		err = s.Stream.Close()
+		atomic.AddInt32(&s.m.streams, -1)
+	})
+	return err
+}
+
+// DialQUIC connects to a server's QUIC listener on its own UDP socket.
+func DialQUIC(raddr string, tlsConfig *tls.Config, dscp, sockbuf int) (*QUICMux, error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	setSockOpts(conn, dscp, sockbuf)
+	tr := &quic.Transport{Conn: conn}
+	ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+	defer cancel()
+	qconn, err := tr.Dial(ctx, udpaddr, withALPN(tlsConfig), quicConfig())
+	if err != nil {
+		tr.Close()
+		conn.Close()
+		return nil, err
+	}
+	go func() {
+		<-qconn.Context().Done()
+		tr.Close()
+		conn.Close()
+	}()
+	return &QUICMux{conn: qconn}, nil
+}
+
+// quicPipe is the PacketConn of the QUIC listener on a KCP Listener.
+type quicPipe struct {
+	l  *Listener
+	ch chan packet
+
+	mu      sync.Mutex
+	expired chan struct{} // closed while the read deadline has passed
+}
+
+func (p *quicPipe) ReadFrom(b []byte) (int, net.Addr, error) {
+	p.mu.Lock()
+	expired := p.expired
+	p.mu.Unlock()
+	select {
+	case pkt := <-p.ch:
+		return copy(b, pkt.data), pkt.addr, nil
+	case <-expired:
+		return 0, nil, errDeadline
+	case <-p.l.die:
+		return 0, nil, errClosed
+	}
+}
+
+func (p *quicPipe) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return p.l.conn.WriteTo(b, addr)
+}
+
+// SetReadDeadline only tells deadlines passed from none, which is how quic-go
+// stops reading.
+func (p *quicPipe) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.expired:
+		if t.IsZero() || t.After(time.Now()) {
+			p.expired = make(chan struct{})
+		}
+	default:
+		if !t.IsZero() && !t.After(time.Now()) {
+			close(p.expired)
+		}
+	}
+	return nil
+}
+
+// the listener sizes and closes the socket
+func (p *quicPipe) SetReadBuffer(bytes int) error      { return nil }
+func (p *quicPipe) SetWriteBuffer(bytes int) error     { return nil }
+func (p *quicPipe) Close() error                       { return nil }
+func (p *quicPipe) LocalAddr() net.Addr                { return p.l.conn.LocalAddr() }
+func (p *quicPipe) SetDeadline(t time.Time) error      { return p.SetReadDeadline(t) }
+func (p *quicPipe) SetWriteDeadline(t time.Time) error { return nil }
+
+// QUICListener accepts QUIC tunnels.
+type QUICListener struct {
+	*quic.Listener
+}
+
+func (l *QUICListener) Accept() (*QUICMux, error) {
+	conn, err := l.Listener.Accept(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &QUICMux{conn: conn}, nil
+}
+
+// ListenQUIC accepts QUIC tunnels on the socket of l.
+func (l *Listener) ListenQUIC(tlsConfig *tls.Config) (*QUICListener, error) {
+	p := &quicPipe{l: l, ch: make(chan packet, fecQueueLen), expired: make(chan struct{})}
+	ql, err := quic.Listen(p, withALPN(tlsConfig), quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.quic = p
+	l.mu.Unlock()
+	return &QUICListener{ql}, nil
+}
+
+// ServerTLSConfig loads the certificate of a server, or makes a self-signed
+// one without certFile and keyFile.
+func ServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if certFile != "" || keyFile != "" {
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	} else {
+		log.Println("no certificate given, using a self-signed one, clients have to skip verifying it")
+		cert, err = selfSignedCert()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: quicALPN},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,206 @@
+package kcptun
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kcpLike returns packets looking like KCP ones of every parity to the
+// demultiplexer, and a valid MTU probe.
+func kcpLike() [][]byte {
+	var pkts [][]byte
+	for parity := 0; parity <= MaxParity; parity++ {
+		b := make([]byte, 64)
+		rand.Read(b)
+		b[0] = byte(parity)
+		pkts = append(pkts, b)
+	}
+	probe := make([]byte, 200)
+	probe[0] = mtuProbe
+	rand.Read(probe[1:mtuProbeHdrLen])
+	return append(pkts, probe)
+}
+
+func TestQUICOnKCPSocket(t *testing.T) {
+	l, err := ListenKCP("127.0.0.1:0", nil, 10, 0, 1<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	serverTLS, err := ServerTLSConfig("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ql, err := l.ListenQUIC(serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ql.Close()
+
+	// echo every stream
+	go func() {
+		for {
+			m, err := ql.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					s, err := m.AcceptStream()
+					if err != nil {
+						return
+					}
+					go func() {
+						io.Copy(s, s)
+						s.Close()
+					}()
+				}
+			}()
+		}
+	}()
+
+	// KCP traffic on the same socket meanwhile
+	noise, err := net.DialUDP("udp", nil, l.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer noise.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			for _, pkt := range kcpLike() {
+				noise.Write(pkt)
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+
+	m, err := DialQUIC(l.Addr().String(), &tls.Config{InsecureSkipVerify: true}, 0, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	const streams = 8
+	var wg sync.WaitGroup
+	opened := make(chan Stream, streams)
+	errs := make(chan error, streams)
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := m.OpenStream()
+			if err != nil {
+				errs <- err
+				return
+			}
+			opened <- s
+			s.SetReadDeadline(time.Now().Add(5 * time.Second))
+			msg := fmt.Sprintf("stream %d over quic", i)
+			if _, err := s.Write([]byte(msg)); err != nil {
+				errs <- err
+				return
+			}
+			echo := make([]byte, len(msg))
+			if _, err := io.ReadFull(s, echo); err != nil {
+				errs <- err
+				return
+			}
+			if string(echo) != msg {
+				errs <- fmt.Errorf("echo %q of %q", echo, msg)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	close(opened)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if n := m.NumStreams(); n != streams {
+		t.Errorf("%d streams open, want %d", n, streams)
+	}
+	for s := range opened {
+		s.Close()
+	}
+	if n := m.NumStreams(); n != 0 {
+		t.Errorf("%d streams open after closing all", n)
+	}
+}
+
+// The demultiplexer hands QUIC packets to the QUIC listener, never KCP
+// packets of any parity, obfuscated or not, nor MTU probes, which it answers.
+func TestDemuxQUIC(t *testing.T) {
+	obfs, err := NewObfs(ObfsPlain, "random:64", []byte("key"), ObfsMaxLen(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range []*Obfs{nil, obfs} {
+		l, err := ListenKCP("127.0.0.1:0", nil, 10, 0, 1<<20, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a QUIC pipe without listener keeps what it gets
+		q := &quicPipe{l: l, ch: make(chan packet, fecQueueLen), expired: make(chan struct{})}
+		l.mu.Lock()
+		l.quic = q
+		l.mu.Unlock()
+
+		conn, err := net.DialUDP("udp", nil, l.Addr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			for _, pkt := range kcpLike() {
+				if o != nil {
+					if pkt[0] == mtuProbe {
+						continue
+					}
+					pkt = o.Seal(pkt[0], pkt[1:])
+				}
+				conn.Write(pkt)
+			}
+		}
+		if o == nil {
+			// the probe was answered every time
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			reply := make([]byte, 64)
+			for i := 0; i < 10; i++ {
+				if n, err := conn.Read(reply); err != nil || n != mtuReplyLen {
+					t.Fatalf("mtu probe %d: %d bytes, %v", i, n, err)
+				}
+			}
+		}
+
+		// a long header QUIC packet, after all the others
+		initial := make([]byte, 1200)
+		rand.Read(initial)
+		initial[0] = 0xc0
+		conn.Write(initial)
+		select {
+		case pkt := <-q.ch:
+			if pkt.data[0] != 0xc0 || len(pkt.data) != len(initial) {
+				t.Errorf("obfs %v: packet % x... of %d bytes reached QUIC", o != nil, pkt.data[:4], len(pkt.data))
+			}
+		case <-time.After(time.Second):
+			t.Errorf("obfs %v: QUIC packet not delivered", o != nil)
+		}
+		if n := len(q.ch); n != 0 {
+			t.Errorf("obfs %v: %d more packets reached QUIC", o != nil, n)
+		}
+		conn.Close()
+		l.Close()
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	c "github.com/elvizlai/sskcp/config"
+	"github.com/elvizlai/sskcp/kcptun"
+)
+
+// allowCompress reports whether clients may use codec.
+func allowCompress(codec string) bool {
+	for _, name := range strings.Split(c.AllowCompress, ",") {
+		if strings.TrimSpace(name) == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// handshake answers the client's Hello with the settings in effect for the
+// session: the client's, limited to what the server allows. Incompatible
+// clients get an error.
+func handshake(ctrl *kcptun.Control, t *tunnel) error {
+	h, err := ctrl.ReadHello(kcptun.CtrlHello)
+	if err != nil {
+		return err
+	}
+	reply := &kcptun.Hello{
+		Version:   kcptun.ProtocolVersion,
+		Transport: t.transport,
+		Compress:  "none",
+		DataShard: c.DataShard,
+		Caps:      kcptun.CommonCaps(h.Caps, kcptun.Capabilities),
+	}
+	if h.Version < reply.Version {
+		reply.Version = h.Version
+	}
+	switch {
+	case h.Version < kcptun.MinProtocolVersion:
+		reply.Error = fmt.Sprintf("protocol version %d too old, the server needs %d to %d",
+			h.Version, kcptun.MinProtocolVersion, kcptun.ProtocolVersion)
+	case h.DataShard != c.DataShard:
+		reply.Error = fmt.Sprintf("data shards %d, the server uses %d", h.DataShard, c.DataShard)
+	}
+	if reply.Error != "" {
+		ctrl.WriteHello(kcptun.CtrlHelloReply, reply)
+		return fmt.Errorf("client %v: %s", t.remote, reply.Error)
+	}
+
+	// QUIC streams aren't compressed
+	if codec, err := kcptun.ParseCodec(h.Compress); err == nil && allowCompress(h.Compress) && t.comp != nil {
+		reply.Compress = h.Compress
+		reply.AutoCompress = h.AutoCompress
+		t.comp.SetCodec(codec, h.AutoCompress)
+	}
+	// FEC and MTU only apply to KCP
+	if t.kcpconn != nil {
+		// a different parity makes the client reconnect
+		reply.ParityShard = kcptun.ClampParity(t.kcpconn.Parity, c.MinParityShard, c.MaxParityShard)
+		reply.MTU = kcptun.ClampMTU(h.MTU)
+		t.kcpconn.SetMtu(reply.MTU)
+	}
+
+	log.Printf("client %v: protocol %d over %s, compress %s (auto %v), parity shards %d, mtu %d\n",
+		t.remote, reply.Version, t.transport, reply.Compress, reply.AutoCompress, reply.ParityShard, reply.MTU)
+	return ctrl.WriteHello(kcptun.CtrlHelloReply, reply)
+}
+
+// serveControl answers the client's control messages until the session
+// ends.
+func serveControl(ctrl *kcptun.Control) {
+	defer ctrl.Close()
+	for {
+		typ, payload, err := ctrl.ReadMsg()
+		if err != nil {
+			return
+		}
+		switch typ {
+		case kcptun.CtrlPing:
+			if err := ctrl.WriteMsg(kcptun.CtrlPong, payload); err != nil {
+				return
+			}
+		case kcptun.CtrlFEC:
+			if len(payload) != 1 {
+				continue
+			}
+			p := kcptun.ClampParity(int(payload[0]), c.MinParityShard, c.MaxParityShard)
+			if err := ctrl.WriteMsg(kcptun.CtrlFEC, []byte{byte(p)}); err != nil {
+				return
+			}
+		}
+	}
+}
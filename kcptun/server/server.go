@@ -2,32 +2,68 @@ package server
 
 import (
 	"crypto/sha1"
+	"crypto/tls"
 	"io"
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
 	"time"
 
 	c "github.com/elvizlai/sskcp/config"
 	"github.com/elvizlai/sskcp/kcptun"
+	"github.com/elvizlai/sskcp/ss/netutil"
 	kcp "github.com/xtaci/kcp-go"
 	"github.com/xtaci/smux"
 	"golang.org/x/crypto/pbkdf2"
 )
 
-// handle multiplex-ed connection
-func handleMux(conn io.ReadWriteCloser, target string) {
-	// stream multiplex
+// tunnel is a client's connection, over KCP, QUIC, WebSocket or the fallback
+// transport.
+type tunnel struct {
+	mux       kcptun.Mux
+	comp      *kcptun.CompStream // nil over QUIC
+	remote    net.Addr
+	transport string
+	kcpconn   *kcptun.Session // nil unless over KCP
+}
+
+// serveSmux multiplexes t.comp with smux.
+func serveSmux(t *tunnel, target string) {
 	smuxConfig := smux.DefaultConfig()
 	smuxConfig.MaxReceiveBuffer = c.SockBuf
 	smuxConfig.KeepAliveInterval = time.Duration(c.KeepAlive) * time.Second
 
-	mux, err := smux.Server(conn, smuxConfig)
+	mux, err := smux.Server(t.comp, smuxConfig)
 	if err != nil {
 		log.Println(err)
+		t.comp.Close()
 		return
 	}
+	t.mux = kcptun.NewSmux(mux)
+	handleMux(t, target)
+}
+
+// handle multiplex-ed connection
+func handleMux(t *tunnel, target string) {
+	mux := t.mux
 	defer mux.Close()
+
+	// the first stream is the control stream
+	stream, err := mux.AcceptStream()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ctrl := kcptun.NewControl(stream)
+	stream.SetReadDeadline(time.Now().Add(kcptun.HandshakeTimeout))
+	if err := handshake(ctrl, t); err != nil {
+		log.Println("handshake:", err)
+		return
+	}
+	stream.SetReadDeadline(time.Time{})
+	go serveControl(ctrl)
+
 	for {
 		p1, err := mux.AcceptStream()
 		if err != nil {
@@ -77,40 +113,133 @@ func handleClient(p1, p2 io.ReadWriteCloser) {
 func RunKCPTun(listenAddr, targetAddr string) {
 	rand.Seed(int64(time.Now().Nanosecond()))
 
+	if c.MinParityShard < 0 || c.MinParityShard > c.MaxParityShard || c.MaxParityShard > kcptun.MaxParity {
+		log.Fatalf("parity shards must be within 0-%d\n", kcptun.MaxParity)
+	}
+	if c.DataShard < 1 {
+		log.Fatalln("data shards must be at least 1")
+	}
+
 	pass := pbkdf2.Key([]byte(c.Key), []byte(c.SALT), 4096, 32, sha1.New)
 
 	block, _ := kcp.NewAESBlockCrypt(pass)
 
-	lis, err := kcp.ListenWithOptions(listenAddr, block, c.DataShard, c.ParityShard)
+	var obfs *kcptun.Obfs
+	if c.Obfs != "" {
+		var err error
+		obfs, err = kcptun.NewObfs(c.Obfs, c.ObfsLength, pass, kcptun.ObfsMaxLen(c.MTU))
+		kcptun.CheckError(err)
+	}
+	lis, err := kcptun.ListenKCP(listenAddr, block, c.DataShard, c.DSCP, c.SockBuf, obfs)
 	kcptun.CheckError(err)
-	log.Println("kcptun server using smux listening on:", listenAddr)
-
-	if err := lis.SetDSCP(c.DSCP); err != nil {
-		log.Println("SetDSCP:", err)
+	log.Printf("kcptun server using smux listening on: %v, parity shards %d-%d\n", listenAddr, c.MinParityShard, c.MaxParityShard)
+	if obfs != nil {
+		log.Println("obfuscating packets:", c.Obfs, c.ObfsLength)
 	}
-
-	if err := lis.SetReadBuffer(c.SockBuf); err != nil {
-		log.Println("SetReadBuffer:", err)
+	if c.TCP && c.WS {
+		log.Fatalln("the tcp fallback and websocket share the tcp port, pick one")
+	}
+	if c.TCP {
+		go serveTCP(listenAddr, targetAddr)
 	}
-	if err := lis.SetWriteBuffer(c.SockBuf); err != nil {
-		log.Println("SetWriteBuffer:", err)
+	if c.WS {
+		go serveWS(listenAddr, targetAddr)
+	}
+	if c.QUIC {
+		go serveQUIC(lis, targetAddr)
 	}
 
 	// go kcptun.SnmpLogger(kcptun.SnmpLog, kcptun.SnmpPeriod)
 
 	for {
 		if conn, err := lis.AcceptKCP(); err == nil {
-			log.Println("remote address:", conn.RemoteAddr())
+			log.Println("remote address:", conn.RemoteAddr(), "parity shards:", conn.Parity)
 			conn.SetStreamMode(true)
 			conn.SetWriteDelay(true)
 			conn.SetNoDelay(c.NoDelay, c.Interval, c.Resend, c.NoCongestion)
 			conn.SetWindowSize(c.SndWnd, c.RcvWnd)
-			conn.SetMtu(c.MTU)
+			conn.SetMtu(kcptun.DefaultMTU)
 			conn.SetACKNoDelay(c.AckNodelay)
-			conn.SetDSCP(c.DSCP)
-			go handleMux(kcptun.NewCompStream(conn), targetAddr)
+			// no compression until the client's choice arrives
+			comp := kcptun.NewCompStream(conn, kcptun.CodecNone, false)
+			go serveSmux(&tunnel{comp: comp, remote: conn.RemoteAddr(), transport: kcptun.TransportKCP, kcpconn: conn}, targetAddr)
 		} else {
-			log.Printf("%+v", err)
+			log.Printf("%+v\n", err)
+			return
+		}
+	}
+}
+
+// serveTCP accepts the fallback transport of clients whose UDP is blocked, on
+// the TCP port of listenAddr.
+func serveTCP(listenAddr, targetAddr string) {
+	var tlsConfig *tls.Config
+	transport := kcptun.TransportTCP
+	if c.TLSCert != "" || c.TLSKey != "" {
+		var err error
+		tlsConfig, err = kcptun.ServerTLSConfig(c.TLSCert, c.TLSKey)
+		kcptun.CheckError(err)
+		transport = kcptun.TransportTLS
+	}
+	ln, err := kcptun.ListenTCP(listenAddr, tlsConfig)
+	kcptun.CheckError(err)
+	log.Println("kcptun server accepting", transport, "fallback on:", listenAddr)
+
+	var tempDelay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if netutil.RetryAccept(err, &tempDelay) {
+				continue
+			}
+			log.Printf("%+v\n", err)
+			return
+		}
+		tempDelay = 0
+		log.Println("remote address:", conn.RemoteAddr(), "over", transport)
+		comp := kcptun.NewCompStream(conn, kcptun.CodecNone, false)
+		go serveSmux(&tunnel{comp: comp, remote: conn.RemoteAddr(), transport: transport}, targetAddr)
+	}
+}
+
+// serveWS accepts the tunnel over WebSocket on the TCP port of listenAddr,
+// for servers behind a reverse proxy or CDN.
+func serveWS(listenAddr, targetAddr string) {
+	var tlsConfig *tls.Config
+	transport := kcptun.TransportWS
+	if c.TLSCert != "" || c.TLSKey != "" {
+		var err error
+		tlsConfig, err = kcptun.ServerTLSConfig(c.TLSCert, c.TLSKey)
+		kcptun.CheckError(err)
+		transport = kcptun.TransportWSS
+	}
+	ln, err := kcptun.ListenTCP(listenAddr, tlsConfig)
+	kcptun.CheckError(err)
+	log.Println("kcptun server accepting", transport, "on:", listenAddr, "path", c.WSPath)
+
+	err = http.Serve(ln, kcptun.WSHandler(c.WSPath, func(conn net.Conn) {
+		log.Println("remote address:", conn.RemoteAddr(), "over", transport)
+		comp := kcptun.NewCompStream(conn, kcptun.CodecNone, false)
+		serveSmux(&tunnel{comp: comp, remote: conn.RemoteAddr(), transport: transport}, targetAddr)
+	}))
+	log.Printf("%+v\n", err)
+}
+
+// serveQUIC accepts QUIC tunnels on the UDP socket of lis.
+func serveQUIC(lis *kcptun.Listener, targetAddr string) {
+	tlsConfig, err := kcptun.ServerTLSConfig(c.TLSCert, c.TLSKey)
+	kcptun.CheckError(err)
+	ql, err := lis.ListenQUIC(tlsConfig)
+	kcptun.CheckError(err)
+	log.Println("kcptun server accepting quic on:", lis.Addr())
+
+	for {
+		mux, err := ql.Accept()
+		if err != nil {
+			log.Printf("%+v\n", err)
+			return
 		}
+		log.Println("remote address:", mux.RemoteAddr(), "over quic")
+		go handleMux(&tunnel{mux: mux, remote: mux.RemoteAddr(), transport: kcptun.TransportQUIC}, targetAddr)
 	}
 }
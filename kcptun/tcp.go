@@ -0,0 +1,65 @@
+package kcptun
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// The tunnel falls back to a TCP connection, optionally TLS, to the same port
+// as the KCP server where UDP is blocked. The smux session on top is the same.
+
+const (
+	tcpDialTimeout = 10 * time.Second
+	tcpKeepAlive   = 30 * time.Second
+)
+
+// Transports a session runs over, as named in Hello.
+const (
+	TransportKCP  = "kcp"
+	TransportTCP  = "tcp"
+	TransportTLS  = "tls"
+	TransportQUIC = "quic"
+	TransportWS   = "ws"
+	TransportWSS  = "wss"
+)
+
+// DialTCP connects to a server's TCP listener, over TLS if tlsConfig is set.
+func DialTCP(raddr string, tlsConfig *tls.Config) (net.Conn, error) {
+	d := &net.Dialer{Timeout: tcpDialTimeout, KeepAlive: tcpKeepAlive}
+	if tlsConfig != nil {
+		return tls.DialWithDialer(d, "tcp", raddr, tlsConfig)
+	}
+	return d.Dial("tcp", raddr)
+}
+
+type tcpKeepAliveListener struct {
+	*net.TCPListener
+}
+
+func (l tcpKeepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetKeepAlive(true)
+	conn.SetKeepAlivePeriod(tcpKeepAlive)
+	return conn, nil
+}
+
+// ListenTCP accepts the fallback transport, over TLS if tlsConfig is set.
+func ListenTCP(laddr string, tlsConfig *tls.Config) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var l net.Listener = tcpKeepAliveListener{ln}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	return l, nil
+}
@@ -0,0 +1,121 @@
+package kcptun
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The tunnel can run over WebSocket, ws or wss, so the server fits behind a
+// reverse proxy or CDN. Every write of the smux session on top is a binary
+// message.
+
+const wsBufSize = 32 * 1024
+
+// wsConn is a net.Conn over the binary messages of a WebSocket.
+type wsConn struct {
+	*websocket.Conn
+	r io.Reader // of the message being read
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// DialWS connects to a server's WebSocket at rawurl, ws:// or wss://. A
+// non-empty host replaces the Host header, for CDNs routing by it.
+func DialWS(rawurl, host string, tlsConfig *tls.Config) (net.Conn, error) {
+	d := &websocket.Dialer{
+		NetDial:          (&net.Dialer{Timeout: tcpDialTimeout, KeepAlive: tcpKeepAlive}).Dial,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: HandshakeTimeout,
+		ReadBufferSize:   wsBufSize,
+		WriteBufferSize:  wsBufSize,
+	}
+	header := http.Header{}
+	if host != "" {
+		header.Set("Host", host)
+	}
+	conn, _, err := d.Dial(rawurl, header)
+	if err != nil {
+		return nil, err
+	}
+	return &wsConn{Conn: conn}, nil
+}
+
+// WSURL returns the URL of the WebSocket at path of addr.
+func WSURL(scheme, addr, path string) string {
+	return (&url.URL{Scheme: scheme, Host: addr, Path: path}).String()
+}
+
+// ParseWSURL parses a ws:// or wss:// URL of a WebSocket.
+func ParseWSURL(rawurl string) (*url.URL, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != TransportWS && u.Scheme != TransportWSS) || u.Host == "" {
+		return nil, fmt.Errorf("%s is not a ws:// or wss:// URL", rawurl)
+	}
+	return u, nil
+}
+
+// WSHandler upgrades requests for path to WebSocket and serves them with
+// handle, which owns the connection.
+func WSHandler(path string, handle func(conn net.Conn)) http.Handler {
+	upgrader := &websocket.Upgrader{
+		HandshakeTimeout: HandshakeTimeout,
+		ReadBufferSize:   wsBufSize,
+		WriteBufferSize:  wsBufSize,
+		// clients aren't browsers, proxies may rewrite the origin
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		handle(&wsConn{Conn: conn})
+	})
+}
@@ -10,8 +10,10 @@ import (
 	"strings"
 
 	c "github.com/elvizlai/sskcp/config"
+	"github.com/elvizlai/sskcp/kcptun"
 	kcps "github.com/elvizlai/sskcp/kcptun/server"
 	ss "github.com/elvizlai/sskcp/shadowsocks"
+	"github.com/elvizlai/sskcp/ss/plugin"
 	sss "github.com/elvizlai/sskcp/ss/server"
 )
 
@@ -21,6 +23,7 @@ func main() {
 	var cmdConfig ss.Config
 	var printVer bool
 	var core int
+	var adminAddr, adminHost string
 
 	flag.BoolVar(&printVer, "version", false, "print version")
 	flag.StringVar(&sss.ConfigFile, "c", "config.json", "specify ss config file")
@@ -30,11 +33,29 @@ func main() {
 	flag.StringVar(&cmdConfig.Method, "m", "", "encryption method, default: aes-256-cfb")
 	flag.IntVar(&core, "core", 0, "maximum number of CPU cores to use, default is determinied by Go runtime")
 	flag.BoolVar((*bool)(&sss.Debug), "d", false, "print debug message")
-	flag.BoolVar(&sss.UDP, "u", false, "UDP Relay")
+	flag.BoolVar(&sss.UDP, "u", false, "UDP Relay, not with -plugin")
+	flag.StringVar(&sss.Plugin, "plugin", "", "SIP003 plugin in front of the shadowsocks ports, e.g. obfs-server")
+	flag.StringVar(&sss.PluginOpts, "plugin-opts", "", "options of the SIP003 plugin, e.g. obfs=http")
+	flag.StringVar(&adminAddr, "admin", "", "listen address of the admin endpoint serving the SIP008 document of a user token on /sip008/TOKEN only, e.g. 127.0.0.1:8080")
+	flag.StringVar(&adminHost, "host", "", "public host of the server in ss:// URIs and SIP008 documents, default the host requested of the admin endpoint")
 
 	flag.IntVar(&c.SndWnd, "snd", 1024, "set send window size(num of packets)")
 	flag.IntVar(&c.RcvWnd, "rcv", 1024, "set receive window size(num of packets)")
 	flag.IntVar(&c.DSCP, "dscp", 46, "set DSCP(6bit)")
+	flag.StringVar(&c.AllowCompress, "compress", "none,snappy,zstd,lz4", "set compressions allowed to clients, comma separated")
+	flag.IntVar(&c.DataShard, "datashard", 10, "set reed-solomon data shards, clients need the same")
+	flag.IntVar(&c.MinParityShard, "minparity", 0, "set minimum parity shards allowed to clients")
+	flag.IntVar(&c.MaxParityShard, "maxparity", 6, "set maximum parity shards allowed to clients")
+	flag.BoolVar(&c.TCP, "tcp", false, "also accept the tunnel over tcp on the kcp port, for clients with UDP blocked")
+	flag.BoolVar(&c.WS, "ws", false, "accept the tunnel over websocket on the kcp port instead of -tcp, over tls with -tlscert")
+	flag.StringVar(&c.WSPath, "wspath", "/", "set websocket path")
+	flag.StringVar(&c.WSURL, "wsurl", "", "public websocket url of the kcp port shared with clients, e.g. wss://cdn.example.com/path, with a single port")
+	flag.BoolVar(&c.QUIC, "quic", false, "also accept the tunnel over quic on the kcp port")
+	flag.StringVar(&c.TLSCert, "tlscert", "", "set certificate file for tls, wss and quic, quic makes a self-signed one without")
+	flag.StringVar(&c.TLSKey, "tlskey", "", "set key file for tls, wss and quic")
+	flag.StringVar(&c.Key, "key", c.Key, "pre-shared secret of the kcp tunnel, the same on both ends")
+	flag.StringVar(&c.Obfs, "obfs", "", "obfuscate kcp packets with a fake header: plain, dtls or webrtc, the same on both ends")
+	flag.StringVar(&c.ObfsLength, "obfslen", "random:128", "set obfuscated packet lengths: none, random:MAX, fixed:SIZE, uniform:MIN-MAX or normal:MEAN,STDDEV")
 
 	flag.IntVar(&c.NoDelay, "nodelay", 0, "set mode param nodelay")
 	flag.IntVar(&c.Interval, "interval", 30, "set mode param interval")
@@ -48,6 +69,31 @@ func main() {
 		os.Exit(0)
 	}
 
+	if remote, local, opts, ok := plugin.FromEnv(); ok {
+		// run as the SIP003 plugin of another shadowsocks implementation,
+		// only the KCP tunnel between the addresses it gives
+		if err := plugin.SetFlags(opts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		log.Println("running as SIP003 plugin:", local, "<->", remote)
+		kcps.RunKCPTun(remote, local)
+		return
+	}
+
+	if sss.UDP && sss.Plugin != "" {
+		// SIP003 plugins only carry TCP, UDP would reach the port unprotected
+		fmt.Fprintln(os.Stderr, "UDP relay bypasses the plugin, -u and -plugin exclude each other")
+		os.Exit(1)
+	}
+
+	if c.WSURL != "" {
+		if _, err := kcptun.ParseWSURL(c.WSURL); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
 	ss.SetDebug(sss.Debug)
 
 	if strings.HasSuffix(cmdConfig.Method, "-auth") {
@@ -78,6 +124,12 @@ func main() {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	switch flag.Arg(0) {
+	case "uri", "sip008":
+		// sskcp_server [flags] uri|sip008 [-host HOST]: share the ports instead
+		export(flag.Arg(0), flag.Args()[1:], adminHost)
+		return
+	}
 	if core > 0 {
 		runtime.GOMAXPROCS(core)
 	}
@@ -91,7 +143,15 @@ func main() {
 		if sss.UDP {
 			go sss.RunUDP(port, password, sss.Config.Auth)
 		}
-		go kcps.RunKCPTun(":"+strconv.Itoa(10000+portNumeric), "127.0.0.1:"+port)
+		go kcps.RunKCPTun(":"+strconv.Itoa(kcptun.PortOffset+portNumeric), "127.0.0.1:"+port)
+	}
+
+	if adminAddr != "" {
+		if err = sss.LoadTokens(); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "error reading tokens from %s: %v\n", sss.ConfigFile, err)
+			os.Exit(1)
+		}
+		go sss.RunAdmin(adminAddr, adminHost)
 	}
 
 	sss.WaitSignal()
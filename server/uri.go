@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	sss "github.com/elvizlai/sskcp/ss/server"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// export runs the subcommands sharing the ports with clients instead of
+// serving them: "uri" prints the ss:// URI and its QR code of every port,
+// "sip008" the SIP008 document of all ports or those of a user token.
+func export(cmd string, args []string, defaultHost string) {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	host := fs.String("host", defaultHost, "public host name or IP address of the server")
+	noQR := fs.Bool("noqr", false, "print the URIs only")
+	token := fs.String("token", "", "only the ports of this user token, see tokens in the config file")
+	fs.Parse(args)
+	if *host == "" {
+		fmt.Fprintln(os.Stderr, "must specify the server host with -host")
+		os.Exit(1)
+	}
+
+	portPassword := sss.Config.PortPassword
+	if *token != "" {
+		if err := sss.LoadTokens(); err != nil {
+			exitOnError(fmt.Errorf("error reading tokens from %s: %v", sss.ConfigFile, err))
+		}
+		var ok bool
+		if portPassword, ok = sss.UserPorts(*token, portPassword); !ok {
+			exitOnError(fmt.Errorf("unknown token %s", *token))
+		}
+	}
+
+	if cmd == "sip008" {
+		doc, err := sss.SIP008(*host, portPassword)
+		exitOnError(err)
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		exitOnError(enc.Encode(doc))
+		return
+	}
+
+	srvs, err := sss.Servers(*host, portPassword)
+	exitOnError(err)
+	for _, srv := range srvs {
+		fmt.Println(srv)
+		if *noQR {
+			continue
+		}
+		qr, err := qrcode.New(srv.String(), qrcode.Medium)
+		exitOnError(err)
+		fmt.Println(qr.ToSmallString(false))
+	}
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
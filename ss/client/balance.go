@@ -0,0 +1,174 @@
+package client
+
+import (
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// Strategies for spreading connections over multiple servers, set by the
+// "strategy" option in the config.
+const (
+	StrategyFailover       = "failover" // default, preferred or first healthy server
+	StrategyRoundRobin     = "round-robin"
+	StrategyRandom         = "random"
+	StrategyLeastConn      = "least-conn"
+	StrategyConsistentHash = "consistent-hash" // same destination host, same server
+)
+
+// ringReplicas is the number of points per server on the hash ring, enough to
+// spread hosts evenly over a handful of servers.
+const ringReplicas = 160
+
+// balancer orders the servers of a pool to try for a connection to host.
+// Servers with an open breaker are still skipped by createServerConn.
+type balancer interface {
+	order(host string) []int
+}
+
+// strategyName is set by SetStrategy before any pool is created.
+var strategyName = StrategyFailover
+
+type failover struct {
+	p *serverPool
+}
+
+// order returns the server preferred by the health check first, the rest in
+// config order.
+func (b failover) order(host string) []int {
+	n := len(b.p.servers)
+	preferred := int(atomic.LoadInt32(&b.p.preferred))
+	if preferred >= n {
+		preferred = 0
+	}
+	order := make([]int, 0, n)
+	order = append(order, preferred)
+	for i := 0; i < n; i++ {
+		if i != preferred {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+type roundRobin struct {
+	p    *serverPool
+	next uint32
+}
+
+func (b *roundRobin) order(host string) []int {
+	n := len(b.p.servers)
+	start := int((atomic.AddUint32(&b.next, 1) - 1) % uint32(n))
+	order := make([]int, n)
+	for i := range order {
+		order[i] = (start + i) % n
+	}
+	return order
+}
+
+type random struct {
+	p *serverPool
+}
+
+func (b random) order(host string) []int {
+	return b.p.perm(len(b.p.servers))
+}
+
+type leastConn struct {
+	p *serverPool
+}
+
+func (b leastConn) order(host string) []int {
+	n := len(b.p.servers)
+	order := make([]int, n)
+	active := make([]int64, n)
+	for i := range order {
+		order[i] = i
+		active[i] = atomic.LoadInt64(&b.p.servers[i].active)
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return active[order[a]] < active[order[b]]
+	})
+	return order
+}
+
+// consistentHash maps each destination host to a point on a ring of server
+// replicas, so adding or removing a server only moves its own share of hosts.
+type consistentHash struct {
+	n      int
+	hashes []uint32
+	nodes  []int // server index at hashes[i]
+}
+
+func newConsistentHash(p *serverPool) *consistentHash {
+	type point struct {
+		hash uint32
+		node int
+	}
+	var points []point
+	for i, s := range p.servers {
+		for r := 0; r < ringReplicas; r++ {
+			h := crc32.ChecksumIEEE([]byte(s.addr + "#" + strconv.Itoa(r)))
+			points = append(points, point{h, i})
+		}
+	}
+	sort.Slice(points, func(a, b int) bool { return points[a].hash < points[b].hash })
+	c := &consistentHash{len(p.servers), make([]uint32, len(points)), make([]int, len(points))}
+	for i, pt := range points {
+		c.hashes[i] = pt.hash
+		c.nodes[i] = pt.node
+	}
+	return c
+}
+
+func (c *consistentHash) order(host string) []int {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	h := crc32.ChecksumIEEE([]byte(host))
+	start := sort.Search(len(c.hashes), func(i int) bool { return c.hashes[i] >= h })
+	seen := make([]bool, c.n)
+	order := make([]int, 0, c.n)
+	for i := 0; i < len(c.hashes) && len(order) < c.n; i++ {
+		node := c.nodes[(start+i)%len(c.hashes)]
+		if !seen[node] {
+			seen[node] = true
+			order = append(order, node)
+		}
+	}
+	return order
+}
+
+func newBalancer(name string, p *serverPool) (balancer, error) {
+	switch name {
+	case StrategyFailover:
+		return failover{p}, nil
+	case StrategyRoundRobin:
+		return &roundRobin{p: p}, nil
+	case StrategyRandom:
+		return random{p}, nil
+	case StrategyLeastConn:
+		return leastConn{p}, nil
+	case StrategyConsistentHash:
+		return newConsistentHash(p), nil
+	}
+	return nil, fmt.Errorf("unknown strategy %s", name)
+}
+
+// SetStrategy selects how connections are spread over the servers. It must
+// be called before ParseServerConfig.
+func SetStrategy(name string) error {
+	if name == "" {
+		name = StrategyFailover
+	}
+	if _, err := newBalancer(name, &serverPool{}); err != nil {
+		return err
+	}
+	strategyName = name
+	log.Println("server selection strategy:", name)
+	return nil
+}
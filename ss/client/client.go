@@ -1,16 +1,20 @@
 package client
 
 import (
+	"bufio"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"log"
-	"math/rand"
 	"net"
+	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	ss "github.com/elvizlai/sskcp/shadowsocks"
+	"github.com/elvizlai/sskcp/ss/netutil"
 )
 
 var Debug ss.DebugLog
@@ -29,10 +33,6 @@ const (
 	socksCmdConnect = 1
 )
 
-func init() {
-	rand.Seed(time.Now().Unix())
-}
-
 func handShake(conn net.Conn) (err error) {
 	const (
 		idVer     = 0
@@ -131,18 +131,17 @@ func getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
 
 	rawaddr = buf[idType:reqLen]
 
-	if Debug {
-		switch buf[idType] {
-		case typeIPv4:
-			host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
-		case typeIPv6:
-			host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
-		case typeDm:
-			host = string(buf[idDm0 : idDm0+buf[idDmLen]])
-		}
-		port := binary.BigEndian.Uint16(buf[reqLen-2 : reqLen])
-		host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	// host is needed by the rules, not only for debug output
+	switch buf[idType] {
+	case typeIPv4:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
+	case typeIPv6:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
+	case typeDm:
+		host = string(buf[idDm0 : idDm0+buf[idDmLen]])
 	}
+	port := binary.BigEndian.Uint16(buf[reqLen-2 : reqLen])
+	host = net.JoinHostPort(host, strconv.Itoa(int(port)))
 
 	return
 }
@@ -150,14 +149,23 @@ func getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
 type ServerCipher struct {
 	server string
 	cipher *ss.Cipher
+	addr   string // address in the config, TCP may be redirected through a tunnel
+	ota    bool
 }
 
-var servers struct {
-	srvCipher []*ServerCipher
-	failCnt   []int // failed connection count
+// ParseServerConfig sets up the servers to connect to. If tunnel is not nil
+// it's called with every server address and TCP connections to that server
+// go to the returned local address instead, e.g. a KCP client. UDP relay
+// keeps using the server directly.
+func ParseServerConfig(config *ss.Config, tunnel func(server string) string) {
+	if err := parseServerConfig(config, tunnel); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func ParseServerConfig(config *ss.Config) {
+// parseServerConfig is ParseServerConfig returning its errors, the servers in
+// use are kept on error.
+func parseServerConfig(config *ss.Config, tunnel func(server string) string) error {
 	hasPort := func(s string) bool {
 		_, port, err := net.SplitHostPort(s)
 		if err != nil {
@@ -166,6 +174,7 @@ func ParseServerConfig(config *ss.Config) {
 		return port != ""
 	}
 
+	var srvCipher []*ServerCipher
 	if len(config.ServerPassword) == 0 {
 		method := config.Method
 		if config.Auth {
@@ -174,31 +183,32 @@ func ParseServerConfig(config *ss.Config) {
 		// only one encryption table
 		cipher, err := ss.NewCipher(method, config.Password)
 		if err != nil {
-			log.Fatal("Failed generating ciphers:", err)
+			return fmt.Errorf("failed generating ciphers: %v", err)
 		}
 		srvPort := strconv.Itoa(config.ServerPort)
 		srvArr := config.GetServerArray()
 		n := len(srvArr)
-		servers.srvCipher = make([]*ServerCipher, n)
+		srvCipher = make([]*ServerCipher, n)
 
 		for i, s := range srvArr {
 			if hasPort(s) {
 				log.Println("ignore server_port option for server", s)
-				servers.srvCipher[i] = &ServerCipher{s, cipher}
+				srvCipher[i] = &ServerCipher{s, cipher, s, config.Auth}
 			} else {
-				servers.srvCipher[i] = &ServerCipher{net.JoinHostPort(s, srvPort), cipher}
+				s = net.JoinHostPort(s, srvPort)
+				srvCipher[i] = &ServerCipher{s, cipher, s, config.Auth}
 			}
 		}
 	} else {
 		// multiple servers
 		n := len(config.ServerPassword)
-		servers.srvCipher = make([]*ServerCipher, n)
+		srvCipher = make([]*ServerCipher, n)
 
 		cipherCache := make(map[string]*ss.Cipher)
 		i := 0
 		for _, serverInfo := range config.ServerPassword {
 			if len(serverInfo) < 2 || len(serverInfo) > 3 {
-				log.Fatalf("server %v syntax error\n", serverInfo)
+				return fmt.Errorf("server %v syntax error", serverInfo)
 			}
 			server := serverInfo[0]
 			passwd := serverInfo[1]
@@ -207,7 +217,7 @@ func ParseServerConfig(config *ss.Config) {
 				encmethod = serverInfo[2]
 			}
 			if !hasPort(server) {
-				log.Fatalf("no port for server %s\n", server)
+				return fmt.Errorf("no port for server %s", server)
 			}
 			// Using "|" as delimiter is safe here, since no encryption
 			// method contains it in the name.
@@ -217,59 +227,60 @@ func ParseServerConfig(config *ss.Config) {
 				var err error
 				cipher, err = ss.NewCipher(encmethod, passwd)
 				if err != nil {
-					log.Fatal("Failed generating ciphers:", err)
+					return fmt.Errorf("failed generating ciphers: %v", err)
 				}
 				cipherCache[cacheKey] = cipher
 			}
-			servers.srvCipher[i] = &ServerCipher{server, cipher}
+			ota := strings.HasSuffix(strings.ToLower(encmethod), "-auth")
+			srvCipher[i] = &ServerCipher{server, cipher, server, ota}
 			i++
 		}
 	}
-	servers.failCnt = make([]int, len(servers.srvCipher))
-	for _, se := range servers.srvCipher {
-		log.Println("available remote server", se.server)
+	for _, se := range srvCipher {
+		if tunnel != nil {
+			se.server = tunnel(se.addr)
+			log.Println("available remote server", se.addr, "via tunnel", se.server)
+		} else {
+			log.Println("available remote server", se.server)
+		}
 	}
-	return
-}
-
-func connectToServer(serverId int, rawaddr []byte, addr string) (remote *ss.Conn, err error) {
-	se := servers.srvCipher[serverId]
-	remote, err = ss.DialWithRawAddr(rawaddr, se.server, se.cipher.Copy())
+	p, err := newServerPool(srvCipher, strategyName)
 	if err != nil {
-		log.Println("error connecting to shadowsocks server:", err)
-		const maxFailCnt = 30
-		if servers.failCnt[serverId] < maxFailCnt {
-			servers.failCnt[serverId]++
-		}
-		return nil, err
+		return err
 	}
-	Debug.Printf("connected to %s via %s\n", addr, se.server)
-	servers.failCnt[serverId] = 0
-	return
+	setPool(p)
+	return nil
 }
 
-// Connection to the server in the order specified in the config. On
-// connection failure, try the next server. A failed server will be tried with
-// some probability according to its fail count, so we can discover recovered
-// servers.
-func createServerConn(rawaddr []byte, addr string) (remote *ss.Conn, err error) {
-	const baseFailCnt = 20
-	n := len(servers.srvCipher)
+// Connection to the server in the order given by the selection strategy, by
+// default the order specified in the config with the server preferred by the
+// health check first. On connection failure, try the next server. Servers
+// whose circuit breaker is open are skipped until their cooldown passes, only
+// when no server is available at all they are tried as a last resort.
+func createServerConn(rawaddr []byte, addr string) (remote net.Conn, err error) {
+	p := getPool()
+	if p == nil || len(p.servers) == 0 {
+		return nil, errNoServer
+	}
+	tried := false
 	skipped := make([]int, 0)
-	for i := 0; i < n; i++ {
-		// skip failed server, but try it with some probability
-		if servers.failCnt[i] > 0 && rand.Intn(servers.failCnt[i]+baseFailCnt) != 0 {
+	for _, i := range p.balancer.order(addr) {
+		if !p.servers[i].available() {
 			skipped = append(skipped, i)
 			continue
 		}
-		remote, err = connectToServer(i, rawaddr, addr)
+		tried = true
+		remote, err = p.connect(i, rawaddr, addr)
 		if err == nil {
 			return
 		}
 	}
-	// last resort, try skipped servers, not likely to succeed
+	if tried {
+		return nil, err
+	}
+	// last resort, all servers are down, not likely to succeed
 	for _, i := range skipped {
-		remote, err = connectToServer(i, rawaddr, addr)
+		remote, err = p.connect(i, rawaddr, addr)
 		if err == nil {
 			return
 		}
@@ -277,9 +288,87 @@ func createServerConn(rawaddr []byte, addr string) (remote *ss.Conn, err error)
 	return nil, err
 }
 
+// bufConn is a net.Conn reading through a bufio.Reader, so the first byte can
+// be peeked to tell the proxy protocol apart without losing it.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newBufConn(conn net.Conn) *bufConn {
+	return &bufConn{conn, bufio.NewReader(conn)}
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// getProxyRequest serves SOCKS5, SOCKS4/4a and HTTP clients on the same port.
+// SOCKS requests start with their version number, anything else is taken as
+// HTTP. The returned request is non-nil only for plain HTTP proxying, it has
+// to be sent to the remote before piping. The client is answered by
+// replyProxy.
+func getProxyRequest(conn *bufConn) (rawaddr []byte, addr string, ver byte, req *http.Request, err error) {
+	ss.SetReadTimeout(conn)
+	peek, err := conn.r.Peek(1)
+	if err != nil {
+		return
+	}
+	switch ver = peek[0]; ver {
+	case socksVer5:
+		if err = handShake(conn); err != nil {
+			log.Println("socks handshake:", err)
+			return
+		}
+		if rawaddr, addr, err = getRequest(conn); err != nil {
+			log.Println("error getting request:", err)
+			return
+		}
+	case socksVer4:
+		if rawaddr, addr, err = getRequest4(conn); err != nil {
+			log.Println("error getting socks4 request:", err)
+			conn.Write(socks4Reply(socks4Rejected))
+			return
+		}
+	default:
+		if rawaddr, addr, req, err = getRequestHTTP(conn); err != nil {
+			log.Println("error getting http request:", err)
+			conn.Write(httpBadRequest)
+			return
+		}
+	}
+	return
+}
+
+// replyProxy tells the client of getProxyRequest whether its request is
+// accepted, ver is the first byte of the request.
+func replyProxy(conn net.Conn, ver byte, req *http.Request, accepted bool) (err error) {
+	switch ver {
+	case socksVer5:
+		rep := byte(0x00)
+		if !accepted {
+			rep = 0x02 // connection not allowed by ruleset
+		}
+		_, err = conn.Write([]byte{0x05, rep, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08, 0x43})
+	case socksVer4:
+		code := byte(socks4Granted)
+		if !accepted {
+			code = socks4Rejected
+		}
+		_, err = conn.Write(socks4Reply(code))
+	default:
+		if !accepted {
+			_, err = conn.Write(httpForbidden)
+		} else if req == nil {
+			_, err = conn.Write(httpEstablished)
+		}
+	}
+	return
+}
+
 func handleConnection(conn net.Conn) {
 	if Debug {
-		Debug.Printf("socks connect from %s\n", conn.RemoteAddr().String())
+		Debug.Printf("proxy connect from %s\n", conn.RemoteAddr().String())
 	}
 	closed := false
 	defer func() {
@@ -288,29 +377,30 @@ func handleConnection(conn net.Conn) {
 		}
 	}()
 
-	var err error = nil
-	if err = handShake(conn); err != nil {
-		log.Println("socks handshake:", err)
-		return
-	}
-	rawaddr, addr, err := getRequest(conn)
+	bconn := newBufConn(conn)
+	rawaddr, addr, ver, req, err := getProxyRequest(bconn)
 	if err != nil {
-		log.Println("error getting request:", err)
 		return
 	}
-	// Sending connection established message immediately to client.
-	// This some round trip time for creating socks connection with the client.
-	// But if connection failed, the client will get connection reset error.
-	_, err = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08, 0x43})
-	if err != nil {
+
+	// The rules decide before the client is answered, so rejected requests
+	// are refused. Accepted ones are confirmed immediately, this saves a
+	// round trip for creating the connection with the client. But if the
+	// connection fails, the client will get a connection reset error.
+	action := ruleFor(addr)
+	if err = replyProxy(bconn, ver, req, action.kind != actionReject); err != nil {
 		Debug.Println("send connection confirmation:", err)
 		return
 	}
+	if action.kind == actionReject {
+		Debug.Println("reject", addr)
+		return
+	}
 
-	remote, err := createServerConn(rawaddr, addr)
+	remote, err := dialAction(action, rawaddr, addr)
 	if err != nil {
-		if len(servers.srvCipher) > 1 {
-			log.Println("Failed connect to all avaiable shadowsocks server")
+		if req != nil {
+			bconn.Write(httpBadGateway)
 		}
 		return
 	}
@@ -320,9 +410,33 @@ func handleConnection(conn net.Conn) {
 		}
 	}()
 
+	if req != nil {
+		if err = req.Write(remote); err != nil {
+			Debug.Println("forward http request:", err)
+			return
+		}
+		// one request per connection, see getRequestHTTP
+		ss.PipeThenClose(remote, bconn)
+		Debug.Println("closed connection to", addr)
+		return
+	}
+
+	go ss.PipeThenClose(bconn, remote)
+	ss.PipeThenClose(remote, bconn)
+	closed = true
+	Debug.Println("closed connection to", addr)
+}
+
+// relay connects to addr as decided by the rules and pipes conn to it until
+// either side closes. conn is always closed.
+func relay(conn net.Conn, rawaddr []byte, addr string) {
+	remote, err := dialRemote(rawaddr, addr)
+	if err != nil {
+		conn.Close()
+		return
+	}
 	go ss.PipeThenClose(conn, remote)
 	ss.PipeThenClose(remote, conn)
-	closed = true
 	Debug.Println("closed connection to", addr)
 }
 
@@ -331,13 +445,17 @@ func Run(listenAddr string) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("starting local socks5 server at %v ...\n", listenAddr)
+	log.Printf("starting local proxy server (socks5/socks4/http) at %v ...\n", listenAddr)
+	var tempDelay time.Duration
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Println("accept:", err)
-			continue
+			if netutil.RetryAccept(err, &tempDelay) {
+				continue
+			}
+			log.Fatal(err)
 		}
+		tempDelay = 0
 		go handleConnection(conn)
 	}
 }
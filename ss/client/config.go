@@ -0,0 +1,50 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// Config holds the client options shadowsocks.Config doesn't know about. It's
+// read from the same config file, unknown fields are ignored by both.
+type Config struct {
+	Forwards []Forward    `json:"forwards"`
+	DNS      *DNSConfig   `json:"dns"`
+	Rules    string       `json:"rules"` // rule file, reloaded on SIGHUP
+	Health   *HealthCheck `json:"health_check"`
+	Status   string       `json:"status"`   // listen address of the status endpoint
+	Strategy string       `json:"strategy"` // server selection, see the Strategy constants
+
+	// SIP003 plugin in front of every server, see PluginTunnel
+	Plugin     string `json:"plugin"`
+	PluginOpts string `json:"plugin_opts"`
+
+	Subscription *Subscription `json:"subscription"` // replaces the servers
+}
+
+// Forward is an ss-tunnel style static forward: connections accepted on
+// Local are always sent to Remote through the shadowsocks server.
+type Forward struct {
+	Local  string `json:"local"`  // listen address, e.g. "127.0.0.1:5353"
+	Remote string `json:"remote"` // destination host:port, e.g. "8.8.8.8:53"
+}
+
+func ParseConfig(path string) (config *Config, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return
+	}
+
+	config = &Config{}
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return
+}
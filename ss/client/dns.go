@@ -0,0 +1,409 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	ss "github.com/elvizlai/sskcp/shadowsocks"
+	"github.com/elvizlai/sskcp/ss/netutil"
+)
+
+// DNSConfig configures the local DNS forwarder. Queries are sent to Upstream
+// through the shadowsocks server, except names under Domains which are asked
+// to Local directly.
+type DNSConfig struct {
+	Listen   string   `json:"listen"`   // e.g. "127.0.0.1:53"
+	Upstream string   `json:"upstream"` // default "8.8.8.8:53"
+	UDP      bool     `json:"udp"`      // use the UDP relay instead of DNS over TCP, server must enable UDP relay
+	Local    string   `json:"local"`    // resolver for Domains, e.g. "223.5.5.5:53"
+	Domains  []string `json:"domains"`  // domain suffixes resolved by Local
+}
+
+const (
+	dnsHeaderLen   = 12
+	dnsTypeOPT     = 41
+	dnsFlagTC      = 1 << 9
+	dnsRcodeMask   = 0xf
+	dnsCacheSize   = 4096
+	dnsMaxTTL      = 24 * time.Hour
+	dnsTimeout     = 5 * time.Second
+	dnsMaxPointers = 16 // compression pointers followed per name
+)
+
+var errDNSMsg = errors.New("malformed dns message")
+
+// dnsSkipName returns the offset just past the name starting at off.
+func dnsSkipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errDNSMsg
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			return off + 2, nil
+		default:
+			off += 1 + l
+		}
+	}
+}
+
+// dnsReadName decodes the name at off as a lower case dotted string.
+func dnsReadName(msg []byte, off int) (string, error) {
+	var labels []string
+	for hops := 0; ; {
+		if off >= len(msg) {
+			return "", errDNSMsg
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return strings.ToLower(strings.Join(labels, ".")), nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || hops >= dnsMaxPointers {
+				return "", errDNSMsg
+			}
+			hops++
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+l > len(msg) {
+				return "", errDNSMsg
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// dnsQuestion returns the cache key and the name of the single question in msg.
+func dnsQuestion(msg []byte) (key, name string, err error) {
+	if len(msg) < dnsHeaderLen || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return "", "", errDNSMsg
+	}
+	if name, err = dnsReadName(msg, dnsHeaderLen); err != nil {
+		return
+	}
+	off, err := dnsSkipName(msg, dnsHeaderLen)
+	if err != nil {
+		return
+	}
+	if off+4 > len(msg) {
+		return "", "", errDNSMsg
+	}
+	// name + qtype + qclass
+	key = name + "|" + string(msg[off:off+4])
+	return
+}
+
+// dnsTTLs returns the offsets of the TTL fields of all records in a response
+// and the smallest TTL among answer and authority records.
+func dnsTTLs(msg []byte) (offsets []int, minTTL uint32, err error) {
+	if len(msg) < dnsHeaderLen {
+		return nil, 0, errDNSMsg
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	an := int(binary.BigEndian.Uint16(msg[6:]))
+	ns := int(binary.BigEndian.Uint16(msg[8:]))
+	ar := int(binary.BigEndian.Uint16(msg[10:]))
+	off := dnsHeaderLen
+	for i := 0; i < qd; i++ {
+		if off, err = dnsSkipName(msg, off); err != nil {
+			return
+		}
+		off += 4
+	}
+	minTTL = ^uint32(0)
+	for i := 0; i < an+ns+ar; i++ {
+		if off, err = dnsSkipName(msg, off); err != nil {
+			return
+		}
+		// type(2) class(2) ttl(4) rdlength(2)
+		if off+10 > len(msg) {
+			return nil, 0, errDNSMsg
+		}
+		if binary.BigEndian.Uint16(msg[off:]) != dnsTypeOPT {
+			offsets = append(offsets, off+4)
+			if ttl := binary.BigEndian.Uint32(msg[off+4:]); i < an+ns && ttl < minTTL {
+				minTTL = ttl
+			}
+		}
+		off += 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+	}
+	if off > len(msg) {
+		return nil, 0, errDNSMsg
+	}
+	return
+}
+
+type dnsCacheEntry struct {
+	msg     []byte
+	ttlOffs []int
+	stored  time.Time
+	expire  time.Time
+}
+
+type dnsCache struct {
+	sync.Mutex
+	entries map[string]*dnsCacheEntry
+}
+
+// get returns a copy of the cached response for key with TTLs reduced by the
+// time spent in the cache and the id of the query.
+func (c *dnsCache) get(key string, id []byte) []byte {
+	c.Lock()
+	e, ok := c.entries[key]
+	c.Unlock()
+	now := time.Now()
+	if !ok || now.After(e.expire) {
+		return nil
+	}
+	msg := make([]byte, len(e.msg))
+	copy(msg, e.msg)
+	copy(msg, id)
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, off := range e.ttlOffs {
+		ttl := binary.BigEndian.Uint32(msg[off:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(msg[off:], ttl)
+	}
+	return msg
+}
+
+func (c *dnsCache) put(key string, msg []byte) {
+	// only cache complete, successful or NXDOMAIN answers
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if rcode := flags & dnsRcodeMask; flags&dnsFlagTC != 0 || (rcode != 0 && rcode != 3) {
+		return
+	}
+	offs, minTTL, err := dnsTTLs(msg)
+	if err != nil || minTTL == 0 || minTTL == ^uint32(0) {
+		return
+	}
+	ttl := time.Duration(minTTL) * time.Second
+	if ttl > dnsMaxTTL {
+		ttl = dnsMaxTTL
+	}
+	now := time.Now()
+	e := &dnsCacheEntry{append([]byte(nil), msg...), offs, now, now.Add(ttl)}
+
+	c.Lock()
+	defer c.Unlock()
+	if len(c.entries) >= dnsCacheSize {
+		for k, v := range c.entries {
+			if now.After(v.expire) {
+				delete(c.entries, k)
+			}
+		}
+		// still full, evict arbitrary entries
+		for k := range c.entries {
+			if len(c.entries) < dnsCacheSize {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = e
+}
+
+type dnsForwarder struct {
+	config      *DNSConfig
+	upstreamRaw []byte
+	cache       *dnsCache
+}
+
+func (f *dnsForwarder) isLocal(name string) bool {
+	if f.config.Local == "" {
+		return false
+	}
+	for _, d := range f.config.Domains {
+		d = strings.ToLower(strings.Trim(d, "."))
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeDirect asks the local resolver over UDP without the tunnel.
+func exchangeDirect(server string, q []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err = conn.Write(q); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, udpBufSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// exchangeTCP sends the query as DNS over TCP through the shadowsocks server.
+func (f *dnsForwarder) exchangeTCP(q []byte) ([]byte, error) {
+	remote, err := createServerConn(f.upstreamRaw, f.config.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Close()
+	remote.SetDeadline(time.Now().Add(dnsTimeout))
+	if err = writeDNSTCP(remote, q); err != nil {
+		return nil, err
+	}
+	return readDNSTCP(remote)
+}
+
+// exchangeUDP sends the query through the shadowsocks UDP relay.
+func (f *dnsForwarder) exchangeUDP(q []byte) ([]byte, error) {
+	r, err := dialUDPRelay()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if err = r.WriteTo(f.upstreamRaw, q); err != nil {
+		return nil, err
+	}
+	r.timeout = dnsTimeout
+	return r.ReadFrom(make([]byte, udpBufSize))
+}
+
+func (f *dnsForwarder) resolve(q []byte) ([]byte, error) {
+	key, name, err := dnsQuestion(q)
+	if err != nil {
+		return nil, err
+	}
+	if resp := f.cache.get(key, q[:2]); resp != nil {
+		Debug.Println("dns cache hit", name)
+		return resp, nil
+	}
+	var resp []byte
+	switch {
+	case f.isLocal(name):
+		Debug.Println("dns local", name)
+		resp, err = exchangeDirect(f.config.Local, q)
+	case f.config.UDP:
+		resp, err = f.exchangeUDP(q)
+	default:
+		resp, err = f.exchangeTCP(q)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < dnsHeaderLen {
+		return nil, errDNSMsg
+	}
+	f.cache.put(key, resp)
+	return resp, nil
+}
+
+func writeDNSTCP(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readDNSTCP(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (f *dnsForwarder) serveTCP(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(udpTimeout))
+		q, err := readDNSTCP(conn)
+		if err != nil {
+			return
+		}
+		resp, err := f.resolve(q)
+		if err != nil {
+			log.Println("dns:", err)
+			return
+		}
+		if err = writeDNSTCP(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// RunDNS serves DNS on config.Listen over UDP and TCP.
+func RunDNS(config *DNSConfig) {
+	// an empty address would listen on a random port
+	if config.Listen == "" {
+		log.Fatalln("dns: no listen address, e.g. 127.0.0.1:53")
+	}
+	if config.Upstream == "" {
+		config.Upstream = "8.8.8.8:53"
+	}
+	upstreamRaw, err := ss.RawAddr(config.Upstream)
+	if err != nil {
+		log.Fatalf("dns: invalid upstream %s: %v\n", config.Upstream, err)
+	}
+	f := &dnsForwarder{config, upstreamRaw, &dnsCache{entries: map[string]*dnsCacheEntry{}}}
+
+	ln, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		var tempDelay time.Duration
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if netutil.RetryAccept(err, &tempDelay) {
+					continue
+				}
+				log.Fatal(err)
+			}
+			tempDelay = 0
+			go f.serveTCP(conn)
+		}
+	}()
+
+	pc, err := net.ListenPacket("udp", config.Listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("starting local dns server at %v, upstream %v ...\n", config.Listen, config.Upstream)
+	for {
+		buf := make([]byte, udpBufSize)
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Println("dns read:", err)
+			continue
+		}
+		go func(q []byte, src net.Addr) {
+			resp, err := f.resolve(q)
+			if err != nil {
+				log.Println("dns:", err)
+				return
+			}
+			pc.WriteTo(resp, src)
+		}(buf[:n], src)
+	}
+}
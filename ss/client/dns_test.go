@@ -0,0 +1,232 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+const dnsTypeA = 1
+
+// dnsName encodes a dotted name as labels.
+func dnsName(name string) []byte {
+	var b []byte
+	for _, l := range bytes.Split([]byte(name), []byte(".")) {
+		b = append(append(b, byte(len(l))), l...)
+	}
+	return append(b, 0)
+}
+
+// dnsPtr is a compression pointer to off.
+func dnsPtr(off int) []byte {
+	return []byte{0xc0 | byte(off>>8), byte(off)}
+}
+
+func dnsHeader(flags uint16, qd, an, ns, ar int) []byte {
+	b := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(b, 0x1234)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(qd))
+	binary.BigEndian.PutUint16(b[6:], uint16(an))
+	binary.BigEndian.PutUint16(b[8:], uint16(ns))
+	binary.BigEndian.PutUint16(b[10:], uint16(ar))
+	return b
+}
+
+func dnsQuestionSection(name []byte) []byte {
+	return append(append([]byte(nil), name...), 0, dnsTypeA, 0, 1)
+}
+
+func dnsRR(name []byte, typ uint16, ttl uint32, rdata []byte) []byte {
+	b := append([]byte(nil), name...)
+	var f [10]byte
+	binary.BigEndian.PutUint16(f[0:], typ)
+	binary.BigEndian.PutUint16(f[2:], 1)
+	binary.BigEndian.PutUint32(f[4:], ttl)
+	binary.BigEndian.PutUint16(f[8:], uint16(len(rdata)))
+	return append(append(b, f[:]...), rdata...)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// dnsAnswer is a response to an A query of name with an answer per ttl, the
+// answers compress their name to the question's.
+func dnsAnswer(name string, ttls ...uint32) []byte {
+	msg := concat(dnsHeader(0x8180, 1, len(ttls), 0, 0), dnsQuestionSection(dnsName(name)))
+	for _, ttl := range ttls {
+		msg = append(msg, dnsRR(dnsPtr(dnsHeaderLen), dnsTypeA, ttl, []byte{10, 0, 0, 1})...)
+	}
+	return msg
+}
+
+func TestDNSReadName(t *testing.T) {
+	question := concat(dnsHeader(0, 1, 0, 0, 0), dnsQuestionSection(dnsName("WWW.Example.com")))
+	for _, tt := range []struct {
+		name string
+		msg  []byte
+		off  int
+		want string // "" for malformed
+	}{
+		{"plain", question, dnsHeaderLen, "www.example.com"},
+		{"root", concat(dnsHeader(0, 1, 0, 0, 0), []byte{0}), dnsHeaderLen, "."},
+		{"pointer", append(question, dnsPtr(dnsHeaderLen)...), len(question), "www.example.com"},
+		{"label then pointer", append(question, append([]byte{3, 'f', 'o', 'o'}, dnsPtr(dnsHeaderLen+4)...)...), len(question), "foo.example.com"},
+		{"pointer loop", concat(dnsHeader(0, 1, 0, 0, 0), dnsPtr(dnsHeaderLen)), dnsHeaderLen, ""},
+		{"pointer past the end", concat(dnsHeader(0, 1, 0, 0, 0), dnsPtr(500)), dnsHeaderLen, ""},
+		{"half a pointer", concat(dnsHeader(0, 1, 0, 0, 0), []byte{0xc0}), dnsHeaderLen, ""},
+		{"truncated label", concat(dnsHeader(0, 1, 0, 0, 0), []byte{7, 'e', 'x'}), dnsHeaderLen, ""},
+		{"no terminator", concat(dnsHeader(0, 1, 0, 0, 0), []byte{2, 'e', 'x'}), dnsHeaderLen, ""},
+		{"empty", dnsHeader(0, 1, 0, 0, 0), dnsHeaderLen, ""},
+	} {
+		got, err := dnsReadName(tt.msg, tt.off)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: read %q", tt.name, got)
+			}
+			continue
+		}
+		if tt.want == "." {
+			tt.want = ""
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestDNSQuestion(t *testing.T) {
+	q := concat(dnsHeader(0x0100, 1, 0, 0, 0), dnsQuestionSection(dnsName("Example.com")))
+	key, name, err := dnsQuestion(q)
+	if err != nil || name != "example.com" {
+		t.Fatalf("question %q, %v", name, err)
+	}
+	// the same question in another case or with another id shares the key
+	q2 := concat(dnsHeader(0x0100, 1, 0, 0, 0), dnsQuestionSection(dnsName("EXAMPLE.COM")))
+	q2[0] = 0x99
+	if key2, _, _ := dnsQuestion(q2); key2 != key {
+		t.Errorf("keys %q and %q of the same question", key, key2)
+	}
+
+	for _, tt := range []struct {
+		name string
+		msg  []byte
+	}{
+		{"short header", q[:dnsHeaderLen-1]},
+		{"no question", dnsHeader(0x0100, 0, 0, 0, 0)},
+		{"two questions", concat(dnsHeader(0x0100, 2, 0, 0, 0), dnsQuestionSection(dnsName("a.com")), dnsQuestionSection(dnsName("b.com")))},
+		{"truncated type", q[:len(q)-2]},
+		{"truncated name", q[:dnsHeaderLen+3]},
+		{"pointer without type", concat(dnsHeader(0x0100, 1, 0, 0, 0), []byte{0xc0})},
+	} {
+		if key, _, err := dnsQuestion(tt.msg); err == nil {
+			t.Errorf("%s: key %q", tt.name, key)
+		}
+	}
+}
+
+func TestDNSTTLs(t *testing.T) {
+	opt := dnsRR([]byte{0}, dnsTypeOPT, 0x8000, nil)
+	for _, tt := range []struct {
+		name   string
+		msg    []byte
+		ttls   int // TTL fields found
+		minTTL uint32
+		bad    bool
+	}{
+		{"one answer", dnsAnswer("example.com", 300), 1, 300, false},
+		{"smallest answer", dnsAnswer("example.com", 300, 60, 3600), 3, 60, false},
+		{"zero ttl", dnsAnswer("example.com", 300, 0), 2, 0, false},
+		{"no records", dnsAnswer("example.com"), 0, ^uint32(0), false},
+		{"additional ignored", concat(dnsHeader(0x8180, 1, 1, 0, 1), dnsQuestionSection(dnsName("example.com")),
+			dnsRR(dnsPtr(dnsHeaderLen), dnsTypeA, 300, []byte{10, 0, 0, 1}),
+			dnsRR(dnsName("ns.example.com"), dnsTypeA, 5, []byte{10, 0, 0, 2})), 2, 300, false},
+		{"opt skipped", concat(dnsHeader(0x8180, 1, 1, 0, 1), dnsQuestionSection(dnsName("example.com")),
+			dnsRR(dnsPtr(dnsHeaderLen), dnsTypeA, 300, []byte{10, 0, 0, 1}), opt), 1, 300, false},
+		{"nxdomain with soa", concat(dnsHeader(0x8183, 1, 0, 1, 0), dnsQuestionSection(dnsName("nx.example.com")),
+			dnsRR(dnsName("example.com"), 6, 900, make([]byte, 22))), 1, 900, false},
+		{"truncated record", dnsAnswer("example.com", 300)[:len(dnsAnswer("example.com", 300))-6], 0, 0, true},
+		{"truncated rdata", dnsAnswer("example.com", 300)[:len(dnsAnswer("example.com", 300))-1], 0, 0, true},
+		{"missing record", concat(dnsHeader(0x8180, 1, 2, 0, 0), dnsQuestionSection(dnsName("example.com")),
+			dnsRR(dnsPtr(dnsHeaderLen), dnsTypeA, 300, []byte{10, 0, 0, 1})), 0, 0, true},
+		{"short header", make([]byte, dnsHeaderLen-1), 0, 0, true},
+	} {
+		offs, minTTL, err := dnsTTLs(tt.msg)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("%s: parsed", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(offs) != tt.ttls || minTTL != tt.minTTL {
+			t.Errorf("%s: %d ttls, min %d, want %d, min %d", tt.name, len(offs), minTTL, tt.ttls, tt.minTTL)
+		}
+		for _, off := range offs {
+			if off+4 > len(tt.msg) {
+				t.Errorf("%s: ttl offset %d past the message", tt.name, off)
+			}
+		}
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	c := &dnsCache{entries: map[string]*dnsCacheEntry{}}
+	id := []byte{0xab, 0xcd}
+
+	// not cached: no TTL to go by, a zero TTL, truncated or failed answers
+	for _, tt := range []struct {
+		name string
+		msg  []byte
+	}{
+		{"no records", dnsAnswer("example.com")},
+		{"zero ttl", dnsAnswer("example.com", 300, 0)},
+		{"truncated flag", concat(dnsHeader(0x8180|dnsFlagTC, 1, 1, 0, 0), dnsAnswer("example.com", 300)[dnsHeaderLen:])},
+		{"servfail", concat(dnsHeader(0x8182, 1, 1, 0, 0), dnsAnswer("example.com", 300)[dnsHeaderLen:])},
+		{"malformed", dnsAnswer("example.com", 300)[:dnsHeaderLen+5]},
+	} {
+		c.put(tt.name, tt.msg)
+		if got := c.get(tt.name, id); got != nil {
+			t.Errorf("%s: cached", tt.name)
+		}
+	}
+
+	msg := dnsAnswer("example.com", 300, 60)
+	c.put("example", msg)
+	got := c.get("example", id)
+	if got == nil {
+		t.Fatal("answer not cached")
+	}
+	if !bytes.Equal(got[:2], id) || !bytes.Equal(got[2:], msg[2:]) {
+		t.Errorf("cached answer % x, want the id of the query and % x", got, msg[2:])
+	}
+
+	// TTLs count down while cached
+	e := c.entries["example"]
+	e.stored = e.stored.Add(-50 * time.Second)
+	got = c.get("example", id)
+	offs, minTTL, _ := dnsTTLs(got)
+	if minTTL != 10 || binary.BigEndian.Uint32(got[offs[0]:]) != 250 {
+		t.Errorf("ttls after 50s: min %d, first %d", minTTL, binary.BigEndian.Uint32(got[offs[0]:]))
+	}
+	if binary.BigEndian.Uint32(e.msg[offs[0]:]) != 300 {
+		t.Error("cached message changed by get")
+	}
+
+	// and the answer expires with its smallest TTL
+	e.expire = time.Now().Add(-time.Millisecond)
+	if got := c.get("example", id); got != nil {
+		t.Error("expired answer returned")
+	}
+
+	// TTLs are capped
+	c.put("long", dnsAnswer("example.org", 30*24*3600))
+	if d := time.Until(c.entries["long"].expire); d > dnsMaxTTL {
+		t.Errorf("cached for %v, more than %v", d, dnsMaxTTL)
+	}
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"log"
+	"net"
+	"time"
+
+	ss "github.com/elvizlai/sskcp/shadowsocks"
+	"github.com/elvizlai/sskcp/ss/netutil"
+)
+
+// RunForward listens on localAddr and forwards every connection to the fixed
+// remoteAddr through the shadowsocks server, skipping the SOCKS handshake.
+func RunForward(localAddr, remoteAddr string) {
+	rawaddr, err := ss.RawAddr(remoteAddr)
+	if err != nil {
+		log.Fatalf("forward %s: invalid remote %s: %v\n", localAddr, remoteAddr, err)
+	}
+	ln, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("forwarding %v to %v ...\n", localAddr, remoteAddr)
+	var tempDelay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if netutil.RetryAccept(err, &tempDelay) {
+				continue
+			}
+			log.Fatal(err)
+		}
+		tempDelay = 0
+		if Debug {
+			Debug.Printf("forward connect from %s to %s\n", conn.RemoteAddr(), remoteAddr)
+		}
+		go relay(conn, rawaddr, remoteAddr)
+	}
+}
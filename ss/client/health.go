@@ -0,0 +1,174 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ss "github.com/elvizlai/sskcp/shadowsocks"
+)
+
+// HealthCheck configures active probing of the servers. Every round each
+// server fetches URL and the time until the first response byte is its
+// score, the lowest one is preferred by the failover strategy.
+type HealthCheck struct {
+	Interval int    `json:"interval"` // seconds between rounds, default 30
+	URL      string `json:"url"`      // plain http, default "http://www.gstatic.com/generate_204"
+}
+
+const (
+	defaultProbeURL = "http://www.gstatic.com/generate_204"
+	probeTimeout    = 10 * time.Second
+	// switch only when the new best is clearly faster, so servers with
+	// similar latency don't flap
+	hysteresisRatio = 0.8
+	hysteresisMin   = 10 * time.Millisecond
+)
+
+// probeTarget is an HTTP request used to measure a server end to end.
+type probeTarget struct {
+	rawaddr []byte
+	req     []byte
+}
+
+func newProbeTarget(probeURL string) (*probeTarget, error) {
+	u, err := url.Parse(probeURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("probe url %s is not plain http", probeURL)
+	}
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+	rawaddr, err := ss.RawAddr(host)
+	if err != nil {
+		return nil, err
+	}
+	req := []byte("HEAD " + u.RequestURI() + " HTTP/1.1\r\nHost: " + u.Host + "\r\nConnection: close\r\n\r\n")
+	return &probeTarget{rawaddr, req}, nil
+}
+
+// probe holds the *probeTarget used by health checks and recovery probes.
+var probe atomic.Value
+
+func init() {
+	t, _ := newProbeTarget(defaultProbeURL)
+	probe.Store(t)
+}
+
+func currentProbe() *probeTarget {
+	return probe.Load().(*probeTarget)
+}
+
+// probeServer measures the time to the first byte of the response to an HTTP
+// request through s, the connections to s and from s to the target included.
+// It is not the round trip to s alone.
+func probeServer(s *server, t *probeTarget) (time.Duration, error) {
+	start := time.Now()
+	remote, err := ss.DialWithRawAddr(t.rawaddr, s.server, s.cipher.Copy())
+	if err != nil {
+		return 0, err
+	}
+	defer remote.Close()
+	remote.SetDeadline(start.Add(probeTimeout))
+	if _, err = remote.Write(t.req); err != nil {
+		return 0, err
+	}
+	if _, err = remote.Read(make([]byte, 1)); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// pickPreferred returns the server to prefer given the latest scores. The
+// current one is kept unless it failed or another one is clearly faster.
+func pickPreferred(rtt []time.Duration, cur int) int {
+	best := -1
+	for i, d := range rtt {
+		if d > 0 && (best < 0 || d < rtt[best]) {
+			best = i
+		}
+	}
+	if best < 0 || best == cur {
+		return cur
+	}
+	if cur >= len(rtt) || rtt[cur] <= 0 {
+		return best
+	}
+	if float64(rtt[best]) < float64(rtt[cur])*hysteresisRatio && rtt[cur]-rtt[best] > hysteresisMin {
+		return best
+	}
+	return cur
+}
+
+func checkServers(p *serverPool) {
+	t := currentProbe()
+	rtt := make([]time.Duration, len(p.servers))
+	var wg sync.WaitGroup
+	for i, s := range p.servers {
+		wg.Add(1)
+		go func(i int, s *server) {
+			defer wg.Done()
+			d, err := probeServer(s, t)
+			if err != nil {
+				Debug.Println("probe", s.addr, err)
+				rtt[i] = -1
+				atomic.StoreInt64(&s.ttfb, -1)
+				s.failure()
+				return
+			}
+			rtt[i] = d
+			atomic.StoreInt64(&s.ttfb, int64(d))
+			s.success()
+		}(i, s)
+	}
+	wg.Wait()
+
+	old := int(atomic.LoadInt32(&p.preferred))
+	cur := pickPreferred(rtt, old)
+	atomic.StoreInt32(&p.preferred, int32(cur))
+
+	var b bytes.Buffer
+	for i, d := range rtt {
+		if d < 0 {
+			fmt.Fprintf(&b, " %s=timeout", p.servers[i].addr)
+		} else {
+			fmt.Fprintf(&b, " %s=%dms", p.servers[i].addr, d/time.Millisecond)
+		}
+	}
+	log.Printf("server probe ttfb:%s, using %s\n", b.String(), p.servers[cur].addr)
+	if cur != old {
+		log.Println("preferred server changed to", p.servers[cur].addr)
+	}
+}
+
+// RunHealthCheck probes all servers periodically, it never returns.
+func RunHealthCheck(hc *HealthCheck) {
+	if hc.Interval <= 0 {
+		hc.Interval = 30
+	}
+	if hc.URL != "" {
+		t, err := newProbeTarget(hc.URL)
+		if err != nil {
+			log.Fatalf("health check: %v\n", err)
+		}
+		probe.Store(t)
+	}
+
+	ticker := time.NewTicker(time.Duration(hc.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		if p := getPool(); p != nil && len(p.servers) > 0 {
+			checkServers(p)
+		}
+		<-ticker.C
+	}
+}
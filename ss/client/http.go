@@ -0,0 +1,50 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	ss "github.com/elvizlai/sskcp/shadowsocks"
+)
+
+var errHTTPScheme = errors.New("http proxy only supports http scheme and CONNECT")
+
+var (
+	httpEstablished = []byte("HTTP/1.1 200 Connection established\r\n\r\n")
+	httpBadRequest  = []byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+	httpForbidden   = []byte("HTTP/1.1 403 Forbidden\r\nConnection: close\r\n\r\n")
+	httpBadGateway  = []byte("HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n")
+)
+
+// getRequestHTTP reads the first request of an HTTP proxy client. For CONNECT
+// the returned request is nil and the connection becomes a plain tunnel. For
+// other methods the request is returned so it can be forwarded to the remote
+// before piping.
+func getRequestHTTP(conn *bufConn) (rawaddr []byte, host string, req *http.Request, err error) {
+	ss.SetReadTimeout(conn)
+	if req, err = http.ReadRequest(conn.r); err != nil {
+		return
+	}
+	if req.Method == http.MethodConnect {
+		host = req.Host
+		req = nil
+	} else {
+		if req.URL.Scheme != "http" || req.URL.Host == "" {
+			err = errHTTPScheme
+			return
+		}
+		host = req.URL.Host
+		if _, _, e := net.SplitHostPort(host); e != nil {
+			host = net.JoinHostPort(host, "80")
+		}
+		// Only this request goes to the remote, follow-up requests may be
+		// meant for another host. The remote closes after its response,
+		// telling the client to reconnect for the next one.
+		req.Header.Del("Proxy-Connection")
+		req.Header.Del("Proxy-Authorization")
+		req.Close = true
+	}
+	rawaddr, err = ss.RawAddr(host)
+	return
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPRequest(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		req  string
+		addr string // "" for a bad request
+	}{
+		{"connect", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", "example.com:443"},
+		{"get", "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com:80"},
+		{"get with port", "GET http://example.com:8080/x HTTP/1.1\r\nHost: example.com:8080\r\n\r\n", "example.com:8080"},
+		{"malformed", "NOT A REQUEST\r\n\r\n", ""},
+		{"bad header", "GET http://example.com/ HTTP/1.1\r\nno colon\r\n\r\n", ""},
+		{"origin form", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", ""},
+		{"https scheme", "GET https://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", ""},
+	} {
+		_, addr, _, reply, err := proxyRequest([]byte(tt.req))
+		if tt.addr == "" {
+			if err == nil {
+				t.Errorf("%s: accepted for %s", tt.name, addr)
+			}
+			if !bytes.Equal(reply, httpBadRequest) {
+				t.Errorf("%s: reply %q, want 400", tt.name, reply)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if addr != tt.addr {
+			t.Errorf("%s: address %s, want %s", tt.name, addr, tt.addr)
+		}
+		if len(reply) != 0 {
+			t.Errorf("%s: answered %q before the rules decided", tt.name, reply)
+		}
+	}
+}
+
+// A plain HTTP request is forwarded alone, requests following it on the
+// client connection are not, the client reconnects for them.
+func TestHTTPForwardOnce(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	var proxyHeaders int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		if r.Header.Get("Proxy-Connection") != "" || r.Header.Get("Proxy-Authorization") != "" {
+			proxyHeaders++
+		}
+		mu.Unlock()
+		fmt.Fprint(w, "hello")
+	}))
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+
+	rules.Lock()
+	saved := rules.set
+	rules.set = &ruleSet{final: ruleAction{kind: actionDirect}}
+	rules.Unlock()
+	defer func() {
+		rules.Lock()
+		rules.set = saved
+		rules.Unlock()
+	}()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(server)
+		close(done)
+	}()
+	req := "GET http://" + host + "/one HTTP/1.1\r\nHost: " + host +
+		"\r\nProxy-Connection: keep-alive\r\nProxy-Authorization: Basic dTpw\r\n\r\n" +
+		"GET http://" + host + "/two HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+	go client.Write([]byte(req))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(client)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("response %s %q", resp.Status, body)
+	}
+	if rest, err := ioutil.ReadAll(r); err != nil || len(rest) != 0 {
+		t.Errorf("after the response: %q, %v, want the connection closed", rest, err)
+	}
+	client.Close()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(paths) != 1 || paths[0] != "/one" {
+		t.Errorf("requests %v forwarded, want [/one]", paths)
+	}
+	if proxyHeaders != 0 {
+		t.Error("proxy headers forwarded")
+	}
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/elvizlai/sskcp/ss/plugin"
+)
+
+// plugins are the running plugins, stopped when the client is told to exit.
+var plugins struct {
+	sync.Mutex
+	running map[*plugin.Plugin]bool
+	once    sync.Once
+}
+
+// PluginTunnel returns a tunnel for ParseServerConfig running the SIP003
+// plugin name with options opts per server, TCP connections to the server go
+// through it. The plugin reaches the server through next if it isn't nil,
+// e.g. a KCP client.
+func PluginTunnel(name, opts string, next func(server string) string) func(server string) string {
+	return func(server string) string {
+		remote := server
+		if next != nil {
+			remote = next(server)
+		}
+		_, local, err := startPlugin(name, opts, remote)
+		if err != nil {
+			log.Fatalf("error starting plugin %s for %s: %v\n", name, server, err)
+		}
+		return local
+	}
+}
+
+// startPlugin runs a plugin to remote on a free local port.
+func startPlugin(name, opts, remote string) (*plugin.Plugin, string, error) {
+	local, err := plugin.FreePort()
+	if err != nil {
+		return nil, "", err
+	}
+	p, err := plugin.Start(name, opts, remote, local)
+	if err != nil {
+		return nil, "", err
+	}
+	plugins.Lock()
+	if plugins.running == nil {
+		plugins.running = make(map[*plugin.Plugin]bool)
+	}
+	plugins.running[p] = true
+	plugins.Unlock()
+	plugins.once.Do(func() { go stopPluginsOnExit() })
+	return p, local, nil
+}
+
+// stopPlugin stops a plugin no longer needed.
+func stopPlugin(p *plugin.Plugin) {
+	plugins.Lock()
+	delete(plugins.running, p)
+	plugins.Unlock()
+	p.Stop()
+}
+
+// stopPluginsOnExit stops all plugins on SIGINT or SIGTERM before exiting,
+// they would outlive the client otherwise where the system can't tie them to
+// it.
+func stopPluginsOnExit() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigChan
+	log.Printf("caught signal %v, stopping plugins\n", sig)
+	plugins.Lock()
+	var wg sync.WaitGroup
+	for p := range plugins.running {
+		wg.Add(1)
+		go func(p *plugin.Plugin) {
+			defer wg.Done()
+			p.Stop()
+		}(p)
+	}
+	plugins.Unlock()
+	wg.Wait()
+	os.Exit(0)
+}
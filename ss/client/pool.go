@@ -0,0 +1,229 @@
+package client
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ss "github.com/elvizlai/sskcp/shadowsocks"
+)
+
+// Circuit breaker states of a server.
+const (
+	breakerClosed   = iota // healthy, used normally
+	breakerOpen            // failing, skipped until its cooldown passes
+	breakerHalfOpen        // cooldown passed, a single trial decides
+)
+
+var breakerStateName = [...]string{"closed", "open", "half-open"}
+
+const (
+	breakerThreshold   = 3                // consecutive failures opening the breaker
+	breakerCooldown    = 10 * time.Second // wait before the first recovery trial
+	breakerMaxCooldown = 5 * time.Minute  // cooldown doubles per failed trial up to this
+	recoveryInterval   = time.Second
+)
+
+var errNoServer = errors.New("no shadowsocks server configured")
+
+// server is a ServerCipher with its runtime state. All counters are accessed
+// atomically.
+type server struct {
+	*ServerCipher
+	failCnt  int32 // consecutive failures
+	active   int64 // open connections
+	state    int32 // breaker state
+	opens    int32 // consecutive times the breaker opened, scales the cooldown
+	openedAt int64 // unix nano the breaker last opened
+	ttfb     int64 // time to first byte of the last probe in nanoseconds, 0 unknown, -1 failed
+}
+
+func (s *server) cooldown() time.Duration {
+	d := breakerCooldown
+	for i := int32(1); i < atomic.LoadInt32(&s.opens) && d < breakerMaxCooldown; i++ {
+		d *= 2
+	}
+	if d > breakerMaxCooldown {
+		d = breakerMaxCooldown
+	}
+	return d
+}
+
+// recoverable reports whether an open breaker's cooldown has passed.
+func (s *server) recoverable() bool {
+	return atomic.LoadInt32(&s.state) == breakerOpen &&
+		time.Now().UnixNano() >= atomic.LoadInt64(&s.openedAt)+int64(s.cooldown())
+}
+
+// available reports whether a connection to s may be attempted. Once the
+// cooldown of an open breaker passes exactly one caller gets through as the
+// half-open trial.
+func (s *server) available() bool {
+	switch atomic.LoadInt32(&s.state) {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		return s.recoverable() && atomic.CompareAndSwapInt32(&s.state, breakerOpen, breakerHalfOpen)
+	}
+	// half-open, the trial is in flight
+	return false
+}
+
+func (s *server) success() {
+	atomic.StoreInt32(&s.failCnt, 0)
+	if atomic.SwapInt32(&s.state, breakerClosed) != breakerClosed {
+		atomic.StoreInt32(&s.opens, 0)
+		log.Println("server", s.addr, "recovered")
+	}
+}
+
+func (s *server) failure() {
+	n := atomic.AddInt32(&s.failCnt, 1)
+	state := atomic.LoadInt32(&s.state)
+	if state == breakerOpen || (state == breakerClosed && n < breakerThreshold) {
+		return
+	}
+	// openedAt goes first, so a concurrent available() never sees the open
+	// state with a stale timestamp
+	atomic.StoreInt64(&s.openedAt, time.Now().UnixNano())
+	if atomic.CompareAndSwapInt32(&s.state, state, breakerOpen) {
+		atomic.AddInt32(&s.opens, 1)
+		log.Printf("server %s down after %d failures, retry in %v\n", s.addr, n, s.cooldown())
+	}
+}
+
+// serverPool is the set of servers to connect through. It's safe for
+// concurrent use, and replaced as a whole when the server list changes.
+type serverPool struct {
+	servers   []*server
+	balancer  balancer
+	preferred int32 // index preferred by the health check
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+
+	die chan struct{}
+}
+
+func newServerPool(srvCipher []*ServerCipher, strategyName string) (*serverPool, error) {
+	p := &serverPool{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+		die:  make(chan struct{}),
+	}
+	for _, se := range srvCipher {
+		p.servers = append(p.servers, &server{ServerCipher: se})
+	}
+	var err error
+	if p.balancer, err = newBalancer(strategyName, p); err != nil {
+		return nil, err
+	}
+	go p.recoveryLoop()
+	return p, nil
+}
+
+func (p *serverPool) close() {
+	close(p.die)
+}
+
+func (p *serverPool) perm(n int) []int {
+	p.randMu.Lock()
+	defer p.randMu.Unlock()
+	return p.rand.Perm(n)
+}
+
+// index finds a server by its address in the config or its tunnel.
+func (p *serverPool) index(addr string) int {
+	for i, s := range p.servers {
+		if s.server == addr || s.addr == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// recoveryLoop probes servers whose breaker cooldown passed, so they come back
+// without a user connection paying for the trial.
+func (p *serverPool) recoveryLoop() {
+	ticker := time.NewTicker(recoveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.die:
+			return
+		case <-ticker.C:
+			for _, s := range p.servers {
+				if s.recoverable() && atomic.CompareAndSwapInt32(&s.state, breakerOpen, breakerHalfOpen) {
+					go p.recoveryProbe(s)
+				}
+			}
+		}
+	}
+}
+
+func (p *serverPool) recoveryProbe(s *server) {
+	d, err := probeServer(s, currentProbe())
+	if err != nil {
+		Debug.Println("recovery probe", s.addr, err)
+		atomic.StoreInt64(&s.ttfb, -1)
+		s.failure()
+		return
+	}
+	atomic.StoreInt64(&s.ttfb, int64(d))
+	s.success()
+}
+
+// connect dials addr through server i and keeps its breaker up to date.
+func (p *serverPool) connect(i int, rawaddr []byte, addr string) (net.Conn, error) {
+	s := p.servers[i]
+	conn, err := ss.DialWithRawAddr(rawaddr, s.server, s.cipher.Copy())
+	if err != nil {
+		log.Println("error connecting to shadowsocks server:", err)
+		s.failure()
+		return nil, err
+	}
+	Debug.Printf("connected to %s via %s\n", addr, s.server)
+	s.success()
+	atomic.AddInt64(&s.active, 1)
+	return &serverConn{Conn: conn, active: &s.active}, nil
+}
+
+var servers struct {
+	sync.RWMutex
+	pool *serverPool
+}
+
+func getPool() *serverPool {
+	servers.RLock()
+	defer servers.RUnlock()
+	return servers.pool
+}
+
+// setPool replaces the server pool. Connections already made through the old
+// pool are not affected.
+func setPool(p *serverPool) {
+	servers.Lock()
+	old := servers.pool
+	servers.pool = p
+	servers.Unlock()
+	if old != nil {
+		old.close()
+	}
+}
+
+// serverConn counts itself as active on its server while open.
+type serverConn struct {
+	*ss.Conn
+	active *int64
+	closed int32
+}
+
+func (c *serverConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(c.active, -1)
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,264 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ss "github.com/elvizlai/sskcp/shadowsocks"
+)
+
+const testMethod, testPassword = "aes-256-cfb", "barfoo!"
+
+// listenServer runs a shadowsocks server on addr, "127.0.0.1:0" for any port,
+// answering the first read of every connection like an HTTP server would.
+func listenServer(t *testing.T, addr string) net.Listener {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := ss.NewCipher(testMethod, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn *ss.Conn) {
+				defer conn.Close()
+				if _, err := conn.Read(make([]byte, 512)); err != nil {
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+				io.Copy(ioutil.Discard, conn)
+			}(ss.NewConn(conn, cipher.Copy()))
+		}
+	}()
+	return ln
+}
+
+// refusedAddr returns a local address nothing listens on.
+func refusedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func newTestPool(t *testing.T, strategy string, addrs ...string) *serverPool {
+	var srvCipher []*ServerCipher
+	for _, addr := range addrs {
+		cipher, err := ss.NewCipher(testMethod, testPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srvCipher = append(srvCipher, &ServerCipher{server: addr, cipher: cipher, addr: addr})
+	}
+	p, err := newServerPool(srvCipher, strategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+var testRawAddr = []byte{3, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0, 80}
+
+func TestCreateServerConnConcurrent(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		ln := listenServer(t, "127.0.0.1:0")
+		defer ln.Close()
+		addrs = append(addrs, ln.Addr().String(), refusedAddr(t))
+	}
+	p := newTestPool(t, StrategyRoundRobin, addrs...)
+	setPool(p)
+	defer setPool(nil)
+
+	var wg sync.WaitGroup
+	var failed int32
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				remote, err := createServerConn(testRawAddr, "example.com:80")
+				if err != nil {
+					atomic.AddInt32(&failed, 1)
+					continue
+				}
+				remote.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed != 0 {
+		t.Errorf("%d connections failed with healthy servers left", failed)
+	}
+	for i, s := range p.servers {
+		want := int32(breakerClosed)
+		if i%2 == 1 {
+			want = breakerOpen
+		}
+		if state := atomic.LoadInt32(&s.state); state != want {
+			t.Errorf("%s: breaker %s, want %s", s.addr, breakerStateName[state], breakerStateName[want])
+		}
+		if active := atomic.LoadInt64(&s.active); active != 0 {
+			t.Errorf("%s: %d active after all closed", s.addr, active)
+		}
+	}
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	s := &server{ServerCipher: &ServerCipher{addr: "test"}}
+	for i := 1; i < breakerThreshold; i++ {
+		s.failure()
+		if s.state != breakerClosed {
+			t.Fatalf("breaker %s after %d failures", breakerStateName[s.state], i)
+		}
+	}
+	s.failure()
+	if s.state != breakerOpen {
+		t.Fatalf("breaker %s after %d failures", breakerStateName[s.state], breakerThreshold)
+	}
+	if s.available() {
+		t.Fatal("open breaker available before its cooldown")
+	}
+
+	// once the cooldown passed, a single caller gets the half-open trial
+	trial := func() {
+		atomic.StoreInt64(&s.openedAt, time.Now().Add(-s.cooldown()).UnixNano())
+		var wg sync.WaitGroup
+		var passed int32
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if s.available() {
+					atomic.AddInt32(&passed, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		if passed != 1 {
+			t.Fatalf("%d callers passed the half-open breaker", passed)
+		}
+		if state := atomic.LoadInt32(&s.state); state != breakerHalfOpen {
+			t.Fatalf("breaker %s during the trial", breakerStateName[state])
+		}
+	}
+
+	trial()
+	s.failure()
+	if s.state != breakerOpen {
+		t.Fatalf("breaker %s after a failed trial", breakerStateName[s.state])
+	}
+	if d := s.cooldown(); d != 2*breakerCooldown {
+		t.Errorf("cooldown %v after a failed trial, want %v", d, 2*breakerCooldown)
+	}
+
+	trial()
+	s.success()
+	if s.state != breakerClosed || s.failCnt != 0 || s.opens != 0 {
+		t.Fatalf("after recovery: breaker %s, %d failures, %d opens", breakerStateName[s.state], s.failCnt, s.opens)
+	}
+	if d := s.cooldown(); d != breakerCooldown {
+		t.Errorf("cooldown %v after recovery, want %v", d, breakerCooldown)
+	}
+}
+
+func TestRecoveryProbe(t *testing.T) {
+	addr := refusedAddr(t)
+	p := newTestPool(t, StrategyFailover, addr)
+	defer p.close()
+	s := p.servers[0]
+	for i := 0; i < breakerThreshold; i++ {
+		if _, err := p.connect(0, testRawAddr, "example.com:80"); err == nil {
+			t.Fatal("connected to a closed port")
+		}
+	}
+	if state := atomic.LoadInt32(&s.state); state != breakerOpen {
+		t.Fatalf("breaker %s after %d failures", breakerStateName[state], breakerThreshold)
+	}
+
+	ln := listenServer(t, addr)
+	defer ln.Close()
+
+	// no probe before the cooldown
+	time.Sleep(recoveryInterval + recoveryInterval/2)
+	if state := atomic.LoadInt32(&s.state); state != breakerOpen {
+		t.Fatalf("breaker %s before the cooldown passed", breakerStateName[state])
+	}
+
+	atomic.StoreInt64(&s.openedAt, time.Now().Add(-s.cooldown()).UnixNano())
+	deadline := time.Now().Add(3 * recoveryInterval)
+	for atomic.LoadInt32(&s.state) != breakerClosed {
+		if time.Now().After(deadline) {
+			t.Fatalf("breaker %s, not recovered by the probe", breakerStateName[atomic.LoadInt32(&s.state)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ttfb := atomic.LoadInt64(&s.ttfb); ttfb <= 0 {
+		t.Errorf("probe time %d after recovery", ttfb)
+	}
+}
+
+func TestSetPoolDuringTraffic(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		ln := listenServer(t, "127.0.0.1:0")
+		defer ln.Close()
+		addrs = append(addrs, ln.Addr().String())
+	}
+	setPool(newTestPool(t, StrategyLeastConn, addrs[0]))
+	defer setPool(nil)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var conns, failed int32
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				remote, err := createServerConn(testRawAddr, "example.com:80")
+				if err != nil {
+					atomic.AddInt32(&failed, 1)
+					continue
+				}
+				atomic.AddInt32(&conns, 1)
+				remote.Close()
+			}
+		}()
+	}
+
+	// every swap gets a fresh pool, closing the one it replaces
+	for i := 0; i < 50; i++ {
+		setPool(newTestPool(t, StrategyLeastConn, addrs[i%2]))
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+
+	if failed != 0 {
+		t.Errorf("%d of %d connections failed while swapping pools", failed, failed+conns)
+	}
+	if conns == 0 {
+		t.Error("no connections made")
+	}
+}
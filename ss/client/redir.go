@@ -0,0 +1,151 @@
+package client
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	ss "github.com/elvizlai/sskcp/shadowsocks"
+	"github.com/elvizlai/sskcp/ss/netutil"
+)
+
+func handleRedir(conn net.Conn) {
+	dst, err := getOrigDst(conn)
+	if err != nil {
+		log.Println("error getting original destination:", err)
+		conn.Close()
+		return
+	}
+	addr := dst.String()
+	if Debug {
+		Debug.Printf("redir connect from %s to %s\n", conn.RemoteAddr(), addr)
+	}
+	rawaddr, err := ss.RawAddr(addr)
+	if err != nil {
+		log.Println("error building request:", err)
+		conn.Close()
+		return
+	}
+	relay(conn, rawaddr, addr)
+}
+
+// RunRedir accepts TCP connections redirected by an iptables REDIRECT rule,
+// e.g.
+//
+//	iptables -t nat -A PREROUTING -p tcp -j REDIRECT --to-ports 1081
+//
+// and forwards them to their original destination. Linux only.
+func RunRedir(listenAddr string) {
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("starting transparent proxy at %v ...\n", listenAddr)
+	var tempDelay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if netutil.RetryAccept(err, &tempDelay) {
+				continue
+			}
+			log.Fatal(err)
+		}
+		tempDelay = 0
+		go handleRedir(conn)
+	}
+}
+
+// tproxyNAT keeps one relay per (client, original destination) pair.
+type tproxyNAT struct {
+	sync.Mutex
+	relays map[string]*udpRelay
+}
+
+func (nat *tproxyNAT) get(key string) *udpRelay {
+	nat.Lock()
+	defer nat.Unlock()
+	return nat.relays[key]
+}
+
+func (nat *tproxyNAT) add(key string, r *udpRelay) {
+	nat.Lock()
+	nat.relays[key] = r
+	nat.Unlock()
+}
+
+func (nat *tproxyNAT) del(key string) {
+	nat.Lock()
+	delete(nat.relays, key)
+	nat.Unlock()
+}
+
+// pipeTProxyReply sends replies from the relay back to src, spoofing dst as
+// the source address, until the association times out.
+func pipeTProxyReply(nat *tproxyNAT, key string, r *udpRelay, src, dst *net.UDPAddr) {
+	defer nat.del(key)
+	defer r.Close()
+	back, err := dialTProxy(dst)
+	if err != nil {
+		log.Println("error binding reply socket for", dst, err)
+		return
+	}
+	defer back.Close()
+	buf := make([]byte, udpBufSize)
+	for {
+		payload, err := r.ReadFrom(buf)
+		if err != nil {
+			Debug.Println("udp relay:", err)
+			return
+		}
+		if _, err = back.WriteToUDP(payload, src); err != nil {
+			Debug.Println("udp reply:", err)
+			return
+		}
+	}
+}
+
+// RunRedirUDP relays UDP intercepted by an iptables TPROXY rule, e.g.
+//
+//	ip rule add fwmark 1 lookup 100
+//	ip route add local 0.0.0.0/0 dev lo table 100
+//	iptables -t mangle -A PREROUTING -p udp -j TPROXY --on-port 1081 --tproxy-mark 1
+//
+// through the shadowsocks UDP relay, so the server must run with -u. Linux only.
+func RunRedirUDP(listenAddr string) {
+	conn, err := listenTProxy(listenAddr)
+	if err != nil {
+		log.Printf("error listening tproxy udp %v: %v\n", listenAddr, err)
+		return
+	}
+	defer conn.Close()
+	log.Printf("starting transparent udp proxy at %v ...\n", listenAddr)
+
+	nat := &tproxyNAT{relays: map[string]*udpRelay{}}
+	buf := make([]byte, udpBufSize)
+	oob := make([]byte, 1024)
+	for {
+		n, src, dst, err := readFromTProxy(conn, buf, oob)
+		if err != nil {
+			Debug.Println("tproxy read:", err)
+			continue
+		}
+		rawaddr, err := ss.RawAddr(dst.String())
+		if err != nil {
+			continue
+		}
+		key := src.String() + "|" + dst.String()
+		r := nat.get(key)
+		if r == nil {
+			if r, err = dialUDPRelay(); err != nil {
+				log.Println("error creating udp relay:", err)
+				continue
+			}
+			nat.add(key, r)
+			go pipeTProxyReply(nat, key, r, src, dst)
+		}
+		if err = r.WriteTo(rawaddr, buf[:n]); err != nil {
+			Debug.Println("udp relay write:", err)
+		}
+	}
+}
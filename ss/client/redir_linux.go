@@ -0,0 +1,202 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst       = 80 // SO_ORIGINAL_DST, linux/netfilter_ipv4.h
+	ip6tSoOriginalDst   = 80 // IP6T_SO_ORIGINAL_DST, linux/netfilter_ipv6/ip6_tables.h
+	ipv6Transparent     = 75 // IPV6_TRANSPARENT, linux/in6.h
+	ipv6RecvOrigDstAddr = 74 // IPV6_RECVORIGDSTADDR, linux/in6.h
+)
+
+// getOrigDst returns the destination of a connection before it was
+// redirected by netfilter.
+func getOrigDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a tcp connection")
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	v4 := tc.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	var addr *net.TCPAddr
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		var b []byte
+		if v4 {
+			// struct sockaddr_in fits in IPv6Mreq, which avoids a raw getsockopt
+			var mreq *syscall.IPv6Mreq
+			if mreq, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); serr != nil {
+				return
+			}
+			b = mreq.Multiaddr[:]
+		} else {
+			// likewise struct sockaddr_in6 fits in IPv6MTUInfo
+			var info *syscall.IPv6MTUInfo
+			if info, serr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tSoOriginalDst); serr != nil {
+				return
+			}
+			b = (*[syscall.SizeofSockaddrInet6]byte)(unsafe.Pointer(&info.Addr))[:]
+		}
+		ip, port, ok := parseSockaddr(b, !v4)
+		if !ok {
+			serr = errors.New("short original destination")
+			return
+		}
+		addr = &net.TCPAddr{IP: ip, Port: port}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, serr
+}
+
+// listenTProxy opens the UDP socket TPROXY delivers to, asking the kernel to
+// report each packet's original destination.
+func listenTProxy(listenAddr string) (*net.UDPConn, error) {
+	laddr, err := net.ResolveUDPAddr("udp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); serr != nil {
+			return
+		}
+		if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); serr != nil {
+			return
+		}
+		if laddr.IP.To4() == nil {
+			// best effort, fails on IPv4 only sockets
+			syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+			syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1)
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// parseSockaddr decodes a struct sockaddr_in, or sockaddr_in6 if v6, as
+// filled in by the kernel.
+func parseSockaddr(b []byte, v6 bool) (ip net.IP, port int, ok bool) {
+	if v6 {
+		if len(b) < syscall.SizeofSockaddrInet6 {
+			return nil, 0, false
+		}
+		ip = make(net.IP, net.IPv6len)
+		copy(ip, b[8:24])
+	} else {
+		if len(b) < 8 {
+			return nil, 0, false
+		}
+		ip = net.IPv4(b[4], b[5], b[6], b[7])
+	}
+	// sin_port and sin6_port are in network byte order
+	return ip, int(b[2])<<8 | int(b[3]), true
+}
+
+// origDstFromOOB finds the original destination in the control messages of
+// a packet read from a TPROXY socket.
+func origDstFromOOB(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		var v6 bool
+		switch {
+		case m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_ORIGDSTADDR:
+		case m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == ipv6RecvOrigDstAddr:
+			v6 = true
+		default:
+			continue
+		}
+		if ip, port, ok := parseSockaddr(m.Data, v6); ok {
+			return &net.UDPAddr{IP: ip, Port: port}, nil
+		}
+	}
+	return nil, errors.New("no original destination in tproxy packet")
+}
+
+// readFromTProxy reads a packet and its original destination.
+func readFromTProxy(conn *net.UDPConn, b, oob []byte) (n int, src, dst *net.UDPAddr, err error) {
+	var oobn int
+	if n, oobn, _, src, err = conn.ReadMsgUDP(b, oob); err != nil {
+		return
+	}
+	dst, err = origDstFromOOB(oob[:oobn])
+	return
+}
+
+// dialTProxy binds a transparent socket to the non-local address addr, used
+// to send replies that appear to come from the original destination.
+func dialTProxy(addr *net.UDPAddr) (*net.UDPConn, error) {
+	var (
+		fd  int
+		err error
+		sa  syscall.Sockaddr
+	)
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+		fd, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	} else {
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP.To16())
+		sa = sa6
+		fd, err = syscall.Socket(syscall.AF_INET6, syscall.SOCK_DGRAM, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "tproxy:"+strconv.Itoa(addr.Port))
+	defer f.Close()
+
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, err
+	}
+	if _, ok := sa.(*syscall.SockaddrInet4); ok {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+	} else {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6Transparent, 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Bind(fd, sa); err != nil {
+		return nil, err
+	}
+	c, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
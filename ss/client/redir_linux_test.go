@@ -0,0 +1,146 @@
+package client
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestParseSockaddr(t *testing.T) {
+	// AF_INET, port 8388, 10.1.2.3
+	sin := []byte{2, 0, 0x20, 0xc4, 10, 1, 2, 3, 0, 0, 0, 0, 0, 0, 0, 0}
+	ip, port, ok := parseSockaddr(sin, false)
+	if !ok || !ip.Equal(net.IPv4(10, 1, 2, 3)) || port != 8388 {
+		t.Fatalf("sockaddr_in: got %v %d %v", ip, port, ok)
+	}
+	if _, _, ok := parseSockaddr(sin[:7], false); ok {
+		t.Fatal("short sockaddr_in accepted")
+	}
+
+	// AF_INET6, port 443, flowinfo, 2001:db8::1, scope id
+	sin6 := make([]byte, syscall.SizeofSockaddrInet6)
+	sin6[0], sin6[2], sin6[3] = 10, 0x01, 0xbb
+	want := net.ParseIP("2001:db8::1")
+	copy(sin6[8:24], want)
+	ip, port, ok = parseSockaddr(sin6, true)
+	if !ok || !ip.Equal(want) || port != 443 {
+		t.Fatalf("sockaddr_in6: got %v %d %v", ip, port, ok)
+	}
+	if _, _, ok := parseSockaddr(sin6[:23], true); ok {
+		t.Fatal("short sockaddr_in6 accepted")
+	}
+}
+
+// cmsg builds a socket control message as the kernel lays it out.
+func cmsg(level, typ int, data []byte) []byte {
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
+
+func TestOrigDstFromOOB(t *testing.T) {
+	sin := []byte{2, 0, 0, 53, 8, 8, 4, 4, 0, 0, 0, 0, 0, 0, 0, 0}
+	sin6 := make([]byte, syscall.SizeofSockaddrInet6)
+	sin6[0], sin6[3] = 10, 53
+	copy(sin6[8:24], net.ParseIP("2001:4860:4860::8888"))
+
+	cases := []struct {
+		name string
+		oob  []byte
+		want string
+	}{
+		{"ipv4", cmsg(syscall.SOL_IP, syscall.IP_ORIGDSTADDR, sin), "8.8.4.4:53"},
+		{"ipv6", cmsg(syscall.SOL_IPV6, ipv6RecvOrigDstAddr, sin6), "[2001:4860:4860::8888]:53"},
+		{"after other message", append(cmsg(syscall.SOL_IP, syscall.IP_TTL, []byte{64, 0, 0, 0}),
+			cmsg(syscall.SOL_IP, syscall.IP_ORIGDSTADDR, sin)...), "8.8.4.4:53"},
+	}
+	for _, c := range cases {
+		dst, err := origDstFromOOB(c.oob)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if dst.String() != c.want {
+			t.Errorf("%s: got %v, want %s", c.name, dst, c.want)
+		}
+	}
+
+	if _, err := origDstFromOOB(cmsg(syscall.SOL_IP, syscall.IP_TTL, []byte{64, 0, 0, 0})); err == nil {
+		t.Error("no original destination accepted")
+	}
+	if _, err := origDstFromOOB(cmsg(syscall.SOL_IP, syscall.IP_ORIGDSTADDR, sin[:4])); err == nil {
+		t.Error("short original destination accepted")
+	}
+}
+
+// Without TPROXY rules the original destination of a packet is the address
+// it was sent to, which is enough to exercise the socket options.
+func TestTProxySocket(t *testing.T) {
+	conn, err := listenTProxy("127.0.0.1:0")
+	if err != nil {
+		t.Skip("needs CAP_NET_ADMIN:", err)
+	}
+	defer conn.Close()
+	laddr := conn.LocalAddr().(*net.UDPAddr)
+
+	// unconnected, the reply comes from another address
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.WriteToUDP([]byte("ping"), laddr); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf, oob := make([]byte, 64), make([]byte, 1024)
+	n, src, dst, err := readFromTProxy(conn, buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("got %q", buf[:n])
+	}
+	if src.String() != client.LocalAddr().String() {
+		t.Errorf("source %v, want %v", src, client.LocalAddr())
+	}
+	if dst.String() != laddr.String() {
+		t.Errorf("original destination %v, want %v", dst, laddr)
+	}
+
+	// replies appear to come from the original destination, usually not a
+	// local address
+	orig := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}
+	reply, err := dialTProxy(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reply.Close()
+	if _, err := reply.WriteToUDP([]byte("pong"), src); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong" || from.String() != orig.String() {
+		t.Errorf("reply %q from %v", buf[:n], from)
+	}
+}
+
+func TestGetOrigDstNotTCP(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if _, err := getOrigDst(a); err == nil {
+		t.Error("original destination of a pipe")
+	}
+}
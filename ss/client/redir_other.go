@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"errors"
+	"net"
+)
+
+var errRedirPlatform = errors.New("transparent proxy is only supported on linux")
+
+func getOrigDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errRedirPlatform
+}
+
+func listenTProxy(listenAddr string) (*net.UDPConn, error) {
+	return nil, errRedirPlatform
+}
+
+func readFromTProxy(conn *net.UDPConn, b, oob []byte) (n int, src, dst *net.UDPAddr, err error) {
+	err = errRedirPlatform
+	return
+}
+
+func dialTProxy(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errRedirPlatform
+}
@@ -0,0 +1,265 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Rules are read from a text file, one per line, first match wins:
+//
+//	# comment
+//	DOMAIN,example.com,DIRECT
+//	DOMAIN-SUFFIX,google.com,PROXY
+//	DOMAIN-KEYWORD,facebook,PROXY,hk.example.com:8388
+//	IP-CIDR,192.168.0.0/16,DIRECT
+//	DST-PORT,25,REJECT
+//	FINAL,PROXY
+//
+// PROXY optionally names the server to use, as written in the config.
+// IP-CIDR only matches requests for literal addresses, domains are not
+// resolved locally. Without a rule file or FINAL everything is proxied.
+const (
+	ruleDomain = iota
+	ruleDomainSuffix
+	ruleDomainKeyword
+	ruleIPCIDR
+	ruleDstPort
+)
+
+const (
+	actionProxy = iota
+	actionDirect
+	actionReject
+)
+
+const directDialTimeout = 5 * time.Second
+
+var errRejected = errors.New("rejected by rule")
+
+type ruleAction struct {
+	kind   int
+	server string // PROXY only, empty for any server
+}
+
+type rule struct {
+	kind   int
+	value  string
+	ipnet  *net.IPNet
+	port   int
+	action ruleAction
+}
+
+type ruleSet struct {
+	rules []rule
+	final ruleAction
+}
+
+var rules struct {
+	sync.RWMutex
+	path string
+	set  *ruleSet
+}
+
+func parseRuleAction(fields []string) (a ruleAction, err error) {
+	switch strings.ToUpper(fields[0]) {
+	case "PROXY":
+		a.kind = actionProxy
+		if len(fields) > 1 {
+			a.server = fields[1]
+		}
+	case "DIRECT":
+		a.kind = actionDirect
+	case "REJECT":
+		a.kind = actionReject
+	default:
+		err = fmt.Errorf("unknown action %s", fields[0])
+	}
+	return
+}
+
+func parseRules(path string) (*ruleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	set := &ruleSet{final: ruleAction{kind: actionProxy}}
+	scanner := bufio.NewScanner(f)
+	for ln := 1; scanner.Scan(); ln++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		kind := strings.ToUpper(fields[0])
+		if kind == "FINAL" {
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("%s:%d: missing action", path, ln)
+			}
+			if set.final, err = parseRuleAction(fields[1:]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, ln, err)
+			}
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: expect TYPE,VALUE,ACTION", path, ln)
+		}
+		r := rule{value: strings.ToLower(fields[1])}
+		switch kind {
+		case "DOMAIN":
+			r.kind = ruleDomain
+		case "DOMAIN-SUFFIX":
+			r.kind = ruleDomainSuffix
+			r.value = strings.Trim(r.value, ".")
+		case "DOMAIN-KEYWORD":
+			r.kind = ruleDomainKeyword
+		case "IP-CIDR", "IP-CIDR6":
+			r.kind = ruleIPCIDR
+			if _, r.ipnet, err = net.ParseCIDR(fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, ln, err)
+			}
+		case "DST-PORT":
+			r.kind = ruleDstPort
+			if r.port, err = strconv.Atoi(fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, ln, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown rule type %s", path, ln, fields[0])
+		}
+		if r.action, err = parseRuleAction(fields[2:]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, ln, err)
+		}
+		set.rules = append(set.rules, r)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+func (r *rule) match(host string, ip net.IP, port int) bool {
+	switch r.kind {
+	case ruleDomain:
+		return ip == nil && host == r.value
+	case ruleDomainSuffix:
+		return ip == nil && (host == r.value || strings.HasSuffix(host, "."+r.value))
+	case ruleDomainKeyword:
+		return ip == nil && strings.Contains(host, r.value)
+	case ruleIPCIDR:
+		return ip != nil && r.ipnet.Contains(ip)
+	case ruleDstPort:
+		return port == r.port
+	}
+	return false
+}
+
+// decide returns the action for a request to addr (host:port).
+func (set *ruleSet) decide(addr string) ruleAction {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return set.final
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	port, _ := strconv.Atoi(portStr)
+	ip := net.ParseIP(host)
+	for i := range set.rules {
+		if set.rules[i].match(host, ip, port) {
+			return set.rules[i].action
+		}
+	}
+	return set.final
+}
+
+// LoadRules reads the rule file at path, replacing the rules in use. On error
+// the current rules are kept.
+func LoadRules(path string) error {
+	set, err := parseRules(path)
+	if err != nil {
+		return err
+	}
+	rules.Lock()
+	rules.path = path
+	rules.set = set
+	rules.Unlock()
+	log.Printf("loaded %d rules from %s\n", len(set.rules), path)
+	return nil
+}
+
+func reloadRules() {
+	rules.RLock()
+	path := rules.path
+	rules.RUnlock()
+	if path == "" {
+		return
+	}
+	log.Println("reloading rules")
+	if err := LoadRules(path); err != nil {
+		log.Printf("error reloading rules, keep current ones: %v\n", err)
+	}
+}
+
+// WaitSignal reloads the rule file on SIGHUP.
+func WaitSignal() {
+	var sigChan = make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		reloadRules()
+	}
+}
+
+// ruleFor returns what the rules decide for addr, proxy without rules.
+func ruleFor(addr string) ruleAction {
+	rules.RLock()
+	defer rules.RUnlock()
+	if rules.set == nil {
+		return ruleAction{kind: actionProxy}
+	}
+	return rules.set.decide(addr)
+}
+
+// dialRemote connects to addr as decided by the rules: through the
+// shadowsocks server, directly, or not at all.
+func dialRemote(rawaddr []byte, addr string) (net.Conn, error) {
+	return dialAction(ruleFor(addr), rawaddr, addr)
+}
+
+// dialAction connects to addr as action says.
+func dialAction(action ruleAction, rawaddr []byte, addr string) (net.Conn, error) {
+	switch action.kind {
+	case actionDirect:
+		Debug.Println("direct", addr)
+		return net.DialTimeout("tcp", addr, directDialTimeout)
+	case actionReject:
+		Debug.Println("reject", addr)
+		return nil, errRejected
+	}
+	p := getPool()
+	if p == nil || len(p.servers) == 0 {
+		return nil, errNoServer
+	}
+	if action.server != "" {
+		if i := p.index(action.server); i >= 0 {
+			return p.connect(i, rawaddr, addr)
+		}
+		log.Println("rule server not found, using any:", action.server)
+	}
+	remote, err := createServerConn(rawaddr, addr)
+	if err != nil && len(p.servers) > 1 {
+		log.Println("Failed connect to all avaiable shadowsocks server")
+	}
+	return remote, err
+}
@@ -0,0 +1,191 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeRules writes a rule file to dir and returns its path.
+func writeRules(t *testing.T, dir, text string) string {
+	path := filepath.Join(dir, "rules.txt")
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sskcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestParseRules(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	set, err := parseRules(writeRules(t, dir, `
+# comment
+
+  domain , Example.COM , direct
+DOMAIN-SUFFIX,.google.com.,PROXY
+DOMAIN-KEYWORD,facebook,PROXY,hk.example.com:8388
+IP-CIDR,192.168.0.0/16,DIRECT
+IP-CIDR6,fd00::/8,DIRECT
+DST-PORT,25,REJECT
+final,direct
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []rule{
+		{kind: ruleDomain, value: "example.com", action: ruleAction{kind: actionDirect}},
+		{kind: ruleDomainSuffix, value: "google.com", action: ruleAction{kind: actionProxy}},
+		{kind: ruleDomainKeyword, value: "facebook", action: ruleAction{kind: actionProxy, server: "hk.example.com:8388"}},
+		{kind: ruleIPCIDR, value: "192.168.0.0/16", action: ruleAction{kind: actionDirect}},
+		{kind: ruleIPCIDR, value: "fd00::/8", action: ruleAction{kind: actionDirect}},
+		{kind: ruleDstPort, value: "25", port: 25, action: ruleAction{kind: actionReject}},
+	}
+	if len(set.rules) != len(want) {
+		t.Fatalf("%d rules, want %d", len(set.rules), len(want))
+	}
+	for i, r := range set.rules {
+		w := want[i]
+		if r.kind != w.kind || r.value != w.value || r.port != w.port || r.action != w.action {
+			t.Errorf("rule %d: %+v, want %+v", i, r, w)
+		}
+		if (r.kind == ruleIPCIDR) != (r.ipnet != nil) {
+			t.Errorf("rule %d: network %v", i, r.ipnet)
+		}
+	}
+	if set.final != (ruleAction{kind: actionDirect}) {
+		t.Errorf("final %+v", set.final)
+	}
+
+	// without FINAL everything else is proxied
+	if set, err = parseRules(writeRules(t, dir, "DST-PORT,25,REJECT\n")); err != nil || set.final != (ruleAction{kind: actionProxy}) {
+		t.Errorf("default final %+v, %v", set.final, err)
+	}
+
+	for _, tt := range []struct {
+		text string
+		line int
+	}{
+		{"DOMAIN,example.com\n", 1},
+		{"# ok\nDOMAIN,example.com,ALLOW\n", 2},
+		{"\nHOST,example.com,DIRECT\n", 2},
+		{"IP-CIDR,192.168.0.0,DIRECT\n", 1},
+		{"IP-CIDR,not an ip/8,DIRECT\n", 1},
+		{"DST-PORT,smtp,REJECT\n", 1},
+		{"DOMAIN,example.com,DIRECT\nFINAL\n", 2},
+		{"FINAL,DROP\n", 1},
+	} {
+		if _, err := parseRules(writeRules(t, dir, tt.text)); err == nil {
+			t.Errorf("%q: parsed", tt.text)
+		} else if !strings.Contains(err.Error(), fmt.Sprintf(":%d:", tt.line)) {
+			t.Errorf("%q: error %q without line %d", tt.text, err, tt.line)
+		}
+	}
+
+	if _, err := parseRules(filepath.Join(dir, "missing")); err == nil {
+		t.Error("parsed a missing file")
+	}
+}
+
+func TestDecideRules(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	set, err := parseRules(writeRules(t, dir, `
+DOMAIN,mail.example.com,PROXY,eu.example.com:8388
+DST-PORT,25,REJECT
+DOMAIN-SUFFIX,example.com,DIRECT
+DOMAIN-KEYWORD,tracker,REJECT
+IP-CIDR,10.0.0.0/8,DIRECT
+IP-CIDR,::1/128,DIRECT
+FINAL,PROXY
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct := ruleAction{kind: actionDirect}
+	reject := ruleAction{kind: actionReject}
+	proxy := ruleAction{kind: actionProxy}
+	for _, tt := range []struct {
+		addr string
+		want ruleAction
+	}{
+		// the first match wins
+		{"mail.example.com:25", ruleAction{kind: actionProxy, server: "eu.example.com:8388"}},
+		{"www.example.com:25", reject},
+		{"www.example.com:443", direct},
+		{"tracker.example.com:443", direct},
+		// names are matched without case and trailing dot
+		{"WWW.Example.COM.:80", direct},
+		{"example.com:80", direct},
+		// a suffix matches whole labels only
+		{"notexample.com:80", proxy},
+		{"ad-tracker.net:443", reject},
+		// networks match literal addresses only, names are not resolved
+		{"10.1.2.3:443", direct},
+		{"[::1]:443", direct},
+		{"11.1.2.3:443", proxy},
+		{"10.example.org:443", proxy},
+		{"no port", proxy},
+	} {
+		if got := set.decide(tt.addr); got != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestReloadRules(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	rules.Lock()
+	savedPath, savedSet := rules.path, rules.set
+	rules.path, rules.set = "", nil
+	rules.Unlock()
+	defer func() {
+		rules.Lock()
+		rules.path, rules.set = savedPath, savedSet
+		rules.Unlock()
+	}()
+
+	if got := ruleFor("example.com:80"); got != (ruleAction{kind: actionProxy}) {
+		t.Errorf("without rules: %+v", got)
+	}
+	path := writeRules(t, dir, "DOMAIN,example.com,DIRECT\n")
+	if err := LoadRules(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := ruleFor("example.com:80"); got.kind != actionDirect {
+		t.Errorf("loaded: %+v", got)
+	}
+
+	// SIGHUP rereads the file, a broken one keeps the rules in use
+	writeRules(t, dir, "DOMAIN,example.com,REJECT\n")
+	reloadRules()
+	if got := ruleFor("example.com:80"); got.kind != actionReject {
+		t.Errorf("reloaded: %+v", got)
+	}
+	writeRules(t, dir, "DOMAIN,example.com\n")
+	reloadRules()
+	if got := ruleFor("example.com:80"); got.kind != actionReject {
+		t.Errorf("after a broken reload: %+v", got)
+	}
+}
+
+func TestDialActionWithoutServers(t *testing.T) {
+	setPool(nil)
+	for _, server := range []string{"", "hk.example.com:8388"} {
+		if _, err := dialAction(ruleAction{kind: actionProxy, server: server}, testRawAddr, "example.com:80"); err != errNoServer {
+			t.Errorf("server %q: %v, want %v", server, err, errNoServer)
+		}
+	}
+}
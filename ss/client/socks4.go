@@ -0,0 +1,89 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	ss "github.com/elvizlai/sskcp/shadowsocks"
+)
+
+const (
+	socksVer4        = 4
+	socks4Granted    = 0x5a
+	socks4Rejected   = 0x5b
+	socks4MaxIdLen   = 255 // userid and domain are NUL terminated, bound them
+	socks4ReqHdrSize = 8   // ver + cmd + 2port + 4ip
+)
+
+var errSocks4Field = errors.New("socks4 userid or domain too long")
+
+// readNulString reads a NUL terminated field of a SOCKS4/4a request.
+func readNulString(r *bufio.Reader) (string, error) {
+	var b []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		if len(b) >= socks4MaxIdLen {
+			return "", errSocks4Field
+		}
+		b = append(b, c)
+	}
+}
+
+// getRequest4 parses a SOCKS4 or SOCKS4a CONNECT request and returns the
+// shadowsocks address header for it. SOCKS4 has no method negotiation, so
+// this is the only message read from the client.
+func getRequest4(conn *bufConn) (rawaddr []byte, host string, err error) {
+	const (
+		idVer  = 0
+		idCmd  = 1
+		idPort = 2
+		idIP0  = 4
+	)
+	buf := make([]byte, socks4ReqHdrSize)
+	ss.SetReadTimeout(conn)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	if buf[idVer] != socksVer4 {
+		err = errVer
+		return
+	}
+	if buf[idCmd] != socksCmdConnect {
+		err = errCmd
+		return
+	}
+	// userid is not used, shadowsocks has its own authentication
+	if _, err = readNulString(conn.r); err != nil {
+		return
+	}
+	port := binary.BigEndian.Uint16(buf[idPort : idPort+2])
+	ip := net.IP(buf[idIP0 : idIP0+net.IPv4len])
+	// SOCKS4a: ip 0.0.0.x with x != 0 means a domain name follows the userid
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		var dm string
+		if dm, err = readNulString(conn.r); err != nil {
+			return
+		}
+		host = net.JoinHostPort(dm, strconv.Itoa(int(port)))
+	} else {
+		host = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+	}
+	rawaddr, err = ss.RawAddr(host)
+	return
+}
+
+// socks4Reply builds the 8 byte reply, the address fields are ignored by
+// clients for CONNECT.
+func socks4Reply(code byte) []byte {
+	return []byte{0, code, 0, 0, 0, 0, 0, 0}
+}
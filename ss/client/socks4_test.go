@@ -0,0 +1,95 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	ss "github.com/elvizlai/sskcp/shadowsocks"
+)
+
+// proxyRequest runs getProxyRequest on the server end of a pipe the client
+// writes req to, and returns what the client was answered before the pipe
+// closed.
+func proxyRequest(req []byte) (rawaddr []byte, addr string, ver byte, reply []byte, err error) {
+	client, server := net.Pipe()
+	// the server may answer before it read all of req
+	go client.Write(req)
+	replied := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(client)
+		client.Close()
+		replied <- b
+	}()
+	// truncated requests end here
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	rawaddr, addr, ver, _, err = getProxyRequest(newBufConn(server))
+	server.Close()
+	return rawaddr, addr, ver, <-replied, err
+}
+
+func TestSocks4Request(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		req  []byte
+		addr string // "" for a rejected request
+	}{
+		{"socks4", []byte{4, 1, 0, 80, 93, 184, 216, 34, 'u', 's', 'e', 'r', 0}, "93.184.216.34:80"},
+		{"socks4 without userid", []byte{4, 1, 1, 187, 10, 0, 0, 1, 0}, "10.0.0.1:443"},
+		{"socks4a", append([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0}, "example.com\x00"...), "example.com:80"},
+		{"socks4a with userid", append([]byte{4, 1, 0x1f, 0x90, 0, 0, 0, 9, 'u', 0}, "example.com\x00"...), "example.com:8080"},
+		{"bind", []byte{4, 2, 0, 80, 10, 0, 0, 1, 0}, ""},
+		{"truncated header", []byte{4, 1, 0, 80, 10}, ""},
+		{"unterminated userid", []byte{4, 1, 0, 80, 10, 0, 0, 1, 'u'}, ""},
+		{"unterminated domain", append([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0}, "example.com"...), ""},
+		{"long userid", append(append([]byte{4, 1, 0, 80, 10, 0, 0, 1}, bytes.Repeat([]byte{'u'}, socks4MaxIdLen+1)...), 0), ""},
+	} {
+		rawaddr, addr, ver, reply, err := proxyRequest(tt.req)
+		if ver != socksVer4 {
+			t.Errorf("%s: version %d", tt.name, ver)
+		}
+		if tt.addr == "" {
+			if err == nil {
+				t.Errorf("%s: accepted for %s", tt.name, addr)
+			}
+			if !bytes.Equal(reply, socks4Reply(socks4Rejected)) {
+				t.Errorf("%s: reply % x, want rejection", tt.name, reply)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if addr != tt.addr {
+			t.Errorf("%s: address %s, want %s", tt.name, addr, tt.addr)
+		}
+		if want, _ := ss.RawAddr(tt.addr); !bytes.Equal(rawaddr, want) {
+			t.Errorf("%s: address header % x, want % x", tt.name, rawaddr, want)
+		}
+		if len(reply) != 0 {
+			t.Errorf("%s: answered % x before the rules decided", tt.name, reply)
+		}
+	}
+}
+
+func TestSocks4Reply(t *testing.T) {
+	for _, accepted := range []bool{true, false} {
+		client, server := net.Pipe()
+		go func() {
+			replyProxy(server, socksVer4, nil, accepted)
+			server.Close()
+		}()
+		reply, _ := ioutil.ReadAll(client)
+		client.Close()
+		want := socks4Reply(socks4Granted)
+		if !accepted {
+			want = socks4Reply(socks4Rejected)
+		}
+		if !bytes.Equal(reply, want) {
+			t.Errorf("accepted %v: reply % x, want % x", accepted, reply, want)
+		}
+	}
+}
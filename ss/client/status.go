@@ -0,0 +1,67 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/elvizlai/sskcp/ss/netutil"
+)
+
+type serverStatus struct {
+	Server    string `json:"server"`
+	State     string `json:"state"`   // circuit breaker: closed, open or half-open
+	TTFB      int64  `json:"ttfb_ms"` // first response byte of the probe request, 0 unknown, -1 failed
+	FailCnt   int32  `json:"fail_cnt"`
+	Active    int64  `json:"active"` // open connections
+	Preferred bool   `json:"preferred"`
+}
+
+type status struct {
+	Strategy     string         `json:"strategy"`
+	Servers      []serverStatus `json:"servers"`
+	AcceptErrors uint64         `json:"accept_errors"` // failed Accept calls of all listeners
+}
+
+func getStatus() *status {
+	st := &status{
+		Strategy:     strategyName,
+		AcceptErrors: atomic.LoadUint64(&netutil.AcceptErrors),
+	}
+	p := getPool()
+	if p == nil {
+		return st
+	}
+	preferred := int(atomic.LoadInt32(&p.preferred))
+	for i, s := range p.servers {
+		e := serverStatus{
+			Server:    s.addr,
+			State:     breakerStateName[atomic.LoadInt32(&s.state)],
+			FailCnt:   atomic.LoadInt32(&s.failCnt),
+			Active:    atomic.LoadInt64(&s.active),
+			Preferred: i == preferred,
+		}
+		if ttfb := atomic.LoadInt64(&s.ttfb); ttfb < 0 {
+			e.TTFB = -1
+		} else {
+			e.TTFB = ttfb / int64(time.Millisecond)
+		}
+		st.Servers = append(st.Servers, e)
+	}
+	return st
+}
+
+// RunStatus serves the client state as JSON on http://listenAddr/status.
+func RunStatus(listenAddr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(getStatus())
+	})
+	log.Printf("status endpoint at http://%v/status\n", listenAddr)
+	log.Fatal(http.ListenAndServe(listenAddr, mux))
+}
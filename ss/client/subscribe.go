@@ -0,0 +1,209 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elvizlai/sskcp/kcptun"
+	ss "github.com/elvizlai/sskcp/shadowsocks"
+	"github.com/elvizlai/sskcp/ss/plugin"
+	"github.com/elvizlai/sskcp/ss/uri"
+)
+
+// Subscription is a server list published centrally, a SIP008 document or
+// base64 encoded ss:// URIs. It replaces the servers of the config and is
+// refreshed periodically. The tunnels of servers that go away are stopped,
+// connections through their KCP sessions drain, those through a plugin end
+// with it.
+type Subscription struct {
+	URL      string `json:"url"`      // http(s) URL or file path
+	Interval int    `json:"interval"` // seconds between refreshes, default 3600
+}
+
+const (
+	defaultSubscriptionInterval = time.Hour
+	subscriptionTimeout         = 30 * time.Second
+	maxSubscriptionSize         = 1 << 20
+)
+
+// subscription keeps the tunnels of the subscribed servers across refreshes,
+// a server that stays gets the same one.
+type subscription struct {
+	*Subscription
+	kcp     func(server string) (string, io.Closer)
+	kcpOpts *string               // options of the KCP client, set by the first sskcp server
+	tunnels map[string]*subTunnel // by server, plugin and options
+}
+
+// subTunnel is where TCP connections to a subscribed server go, through a
+// KCP client or a plugin if any.
+type subTunnel struct {
+	local  string
+	kcp    io.Closer
+	plugin *plugin.Plugin
+}
+
+func (t *subTunnel) stop() {
+	if t.kcp != nil {
+		t.kcp.Close()
+	}
+	if t.plugin != nil {
+		stopPlugin(t.plugin)
+	}
+}
+
+// RunSubscription loads the servers of sub and refreshes them in the
+// background. Servers with the sskcp client as plugin go through kcp, which
+// starts a KCP client to a server and returns its local address and what
+// stops it. Other plugins are started per server.
+func RunSubscription(sub *Subscription, kcp func(server string) (string, io.Closer)) error {
+	s := &subscription{Subscription: sub, kcp: kcp, tunnels: make(map[string]*subTunnel)}
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	go s.refreshLoop()
+	return nil
+}
+
+func (s *subscription) refreshLoop() {
+	interval := defaultSubscriptionInterval
+	if s.Interval > 0 {
+		interval = time.Duration(s.Interval) * time.Second
+	}
+	for range time.Tick(interval) {
+		if err := s.refresh(); err != nil {
+			log.Printf("error refreshing subscription %s: %v, keeping the servers\n", s.URL, err)
+		}
+	}
+}
+
+func (s *subscription) refresh() error {
+	data, err := fetchSubscription(s.URL)
+	if err != nil {
+		return err
+	}
+	srvs, err := uri.ParseSubscription(data)
+	if err != nil {
+		return err
+	}
+	if len(srvs) == 0 {
+		return fmt.Errorf("no servers in subscription %s", s.URL)
+	}
+
+	config := &ss.Config{}
+	locals := make(map[string]string)
+	tunnels := make(map[string]*subTunnel)
+	var started []*subTunnel
+	// tunnels started by a failed refresh are not needed
+	fail := func(err error) error {
+		for _, t := range started {
+			t.stop()
+		}
+		return err
+	}
+	for _, srv := range srvs {
+		addr := srv.Addr()
+		if srv.Plugin == plugin.KCPClient {
+			// the URI has the KCP port, the config the shadowsocks one
+			if srv.Port <= kcptun.PortOffset {
+				return fail(fmt.Errorf("kcp port %d of %s below %d", srv.Port, srv.Host, kcptun.PortOffset))
+			}
+			addr = net.JoinHostPort(srv.Host, strconv.Itoa(srv.Port-kcptun.PortOffset))
+			if err := s.setKCPOpts(addr, srv.PluginOpts); err != nil {
+				return fail(err)
+			}
+		}
+		key := strings.Join([]string{addr, srv.Plugin, srv.PluginOpts}, "|")
+		t, ok := tunnels[key]
+		if !ok {
+			if t, ok = s.tunnels[key]; !ok {
+				if t, err = s.startTunnel(addr, srv); err != nil {
+					return fail(fmt.Errorf("error starting plugin %s for %s: %v", srv.Plugin, addr, err))
+				}
+				started = append(started, t)
+			}
+			tunnels[key] = t
+		}
+		locals[addr] = t.local
+		config.ServerPassword = append(config.ServerPassword, []string{addr, srv.Password, srv.Method})
+	}
+	err = parseServerConfig(config, func(addr string) string {
+		return locals[addr]
+	})
+	if err != nil {
+		return fail(err)
+	}
+	log.Printf("subscription %s: %d servers\n", s.URL, len(srvs))
+	for key, t := range s.tunnels {
+		if _, ok := tunnels[key]; !ok {
+			t.stop()
+		}
+	}
+	s.tunnels = tunnels
+	return nil
+}
+
+// setKCPOpts applies the KCP options of the first sskcp server, they are
+// shared by all KCP clients and can't change while those run.
+func (s *subscription) setKCPOpts(addr, opts string) error {
+	if s.kcpOpts == nil {
+		if err := plugin.SetFlags(opts); err != nil {
+			return fmt.Errorf("kcp options of %s: %v", addr, err)
+		}
+		s.kcpOpts = &opts
+	} else if *s.kcpOpts != opts {
+		log.Println("kcp options of", addr, "differ from the ones in use, restart to apply them")
+	}
+	return nil
+}
+
+// startTunnel starts the tunnel TCP connections to srv at addr go through,
+// none leaves them at addr.
+func (s *subscription) startTunnel(addr string, srv *uri.Server) (*subTunnel, error) {
+	t := &subTunnel{local: addr}
+	switch srv.Plugin {
+	case "":
+	case plugin.KCPClient:
+		// without KCP, sskcp servers take shadowsocks on addr too
+		if s.kcp != nil {
+			t.local, t.kcp = s.kcp(addr)
+		}
+	default:
+		var err error
+		if t.plugin, t.local, err = startPlugin(srv.Plugin, srv.PluginOpts, addr); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// fetchSubscription reads an http(s) URL or a file.
+func fetchSubscription(src string) ([]byte, error) {
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		return ioutil.ReadFile(src)
+	}
+	client := &http.Client{Timeout: subscriptionTimeout}
+	resp, err := client.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("subscription %s: %s", src, resp.Status)
+	}
+	data, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: maxSubscriptionSize + 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSubscriptionSize {
+		return nil, fmt.Errorf("subscription %s larger than %d bytes", src, maxSubscriptionSize)
+	}
+	return data, nil
+}
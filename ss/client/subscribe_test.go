@@ -0,0 +1,221 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/elvizlai/sskcp/kcptun"
+	"github.com/elvizlai/sskcp/ss/plugin"
+	"github.com/elvizlai/sskcp/ss/uri"
+)
+
+// the option of the sskcp servers below, a flag of the client
+var _ = flag.String("key", "", "pre-shared secret of the kcp tunnel")
+
+var (
+	plainServer = &uri.Server{Host: "127.0.0.1", Port: 8001, Method: testMethod, Password: testPassword}
+	kcpServer   = &uri.Server{Host: "127.0.0.1", Port: kcptun.PortOffset + 8002, Method: testMethod, Password: testPassword,
+		Plugin: plugin.KCPClient, PluginOpts: "key=secret"}
+)
+
+func base64List(srvs ...*uri.Server) string {
+	var lines []string
+	for _, srv := range srvs {
+		lines = append(lines, srv.String())
+	}
+	return base64.StdEncoding.EncodeToString([]byte(strings.Join(lines, "\n")))
+}
+
+func sip008(srvs ...*uri.Server) string {
+	b, _ := json.Marshal(&uri.Online{Version: uri.SIP008Version, Servers: srvs})
+	return string(b)
+}
+
+// publisher serves a subscription that can change.
+type publisher struct {
+	mu     sync.Mutex
+	status int
+	body   string
+}
+
+func (p *publisher) set(status int, body string) {
+	p.mu.Lock()
+	p.status, p.body = status, body
+	p.mu.Unlock()
+}
+
+func (p *publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w.WriteHeader(p.status)
+	io.WriteString(w, p.body)
+}
+
+// kcpTunnels fakes the KCP clients of sskcp servers.
+type kcpTunnels struct {
+	mu      sync.Mutex
+	started map[string]int
+	closed  map[string]int
+}
+
+type closer func()
+
+func (f closer) Close() error {
+	f()
+	return nil
+}
+
+func (k *kcpTunnels) start(server string) (string, io.Closer) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.started[server]++
+	return "kcp-" + server, closer(func() {
+		k.mu.Lock()
+		k.closed[server]++
+		k.mu.Unlock()
+	})
+}
+
+func (k *kcpTunnels) counts(server string) (started, closed int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.started[server], k.closed[server]
+}
+
+// poolServers returns the addresses of the servers in use with the local
+// addresses their TCP connections go to.
+func poolServers() map[string]string {
+	m := make(map[string]string)
+	if p := getPool(); p != nil {
+		for _, s := range p.servers {
+			m[s.addr] = s.server
+		}
+	}
+	return m
+}
+
+func TestSubscriptionRefresh(t *testing.T) {
+	pub := &publisher{status: http.StatusOK, body: base64List(plainServer, kcpServer)}
+	ts := httptest.NewServer(pub)
+	defer ts.Close()
+	defer setPool(nil)
+
+	kcp := &kcpTunnels{started: make(map[string]int), closed: make(map[string]int)}
+	s := &subscription{
+		Subscription: &Subscription{URL: ts.URL},
+		kcp:          kcp.start,
+		tunnels:      make(map[string]*subTunnel),
+	}
+	const kcpAddr = "127.0.0.1:8002"
+	want := map[string]string{plainServer.Addr(): plainServer.Addr(), kcpAddr: "kcp-" + kcpAddr}
+
+	check := func(step string, want map[string]string, started, closed int) {
+		got := poolServers()
+		if len(got) != len(want) {
+			t.Errorf("%s: servers %v, want %v", step, got, want)
+		}
+		for addr, local := range want {
+			if got[addr] != local {
+				t.Errorf("%s: server %s via %q, want %q", step, addr, got[addr], local)
+			}
+		}
+		if s, c := kcp.counts(kcpAddr); s != started || c != closed {
+			t.Errorf("%s: kcp tunnel started %d and closed %d times, want %d and %d", step, s, c, started, closed)
+		}
+	}
+
+	if err := s.refresh(); err != nil {
+		t.Fatal("base64:", err)
+	}
+	check("base64", want, 1, 0)
+
+	// the same servers keep their tunnels
+	pub.set(http.StatusOK, sip008(plainServer, kcpServer))
+	if err := s.refresh(); err != nil {
+		t.Fatal("sip008:", err)
+	}
+	check("sip008", want, 1, 0)
+
+	// bad lists keep the servers
+	p := getPool()
+	for _, bad := range []struct {
+		status int
+		body   string
+	}{
+		{http.StatusInternalServerError, sip008(plainServer)},
+		{http.StatusOK, "not a server list"},
+		{http.StatusOK, sip008()},
+		{http.StatusOK, sip008(plainServer, &uri.Server{Host: "127.0.0.1", Port: 8003, Method: testMethod, Password: testPassword,
+			Plugin: plugin.KCPClient})},
+	} {
+		pub.set(bad.status, bad.body)
+		if err := s.refresh(); err == nil {
+			t.Errorf("%d %q: no error", bad.status, bad.body)
+		}
+		if getPool() != p {
+			t.Errorf("%d %q: servers replaced", bad.status, bad.body)
+		}
+		check("bad list", want, 1, 0)
+	}
+
+	// a server going away stops its tunnel
+	pub.set(http.StatusOK, sip008(plainServer))
+	if err := s.refresh(); err != nil {
+		t.Fatal("removal:", err)
+	}
+	check("removal", map[string]string{plainServer.Addr(): plainServer.Addr()}, 1, 1)
+
+	// and coming back starts a new one
+	pub.set(http.StatusOK, base64List(kcpServer))
+	if err := s.refresh(); err != nil {
+		t.Fatal("return:", err)
+	}
+	check("return", map[string]string{kcpAddr: "kcp-" + kcpAddr}, 2, 1)
+}
+
+func TestSubscriptionFailureStopsPlugins(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugin is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "sskcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "plugin")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	started := &uri.Server{Host: "127.0.0.1", Port: 8004, Method: testMethod, Password: testPassword, Plugin: script}
+	broken := &uri.Server{Host: "127.0.0.1", Port: 8005, Method: testMethod, Password: testPassword,
+		Plugin: filepath.Join(dir, "missing")}
+	pub := &publisher{status: http.StatusOK, body: sip008(started, broken)}
+	ts := httptest.NewServer(pub)
+	defer ts.Close()
+
+	s := &subscription{Subscription: &Subscription{URL: ts.URL}, tunnels: make(map[string]*subTunnel)}
+	if err := s.refresh(); err == nil {
+		t.Fatal("refreshed with a missing plugin")
+	}
+	plugins.Lock()
+	running := len(plugins.running)
+	plugins.Unlock()
+	if running != 0 {
+		t.Errorf("%d plugins left running by the failed refresh", running)
+	}
+	if len(s.tunnels) != 0 {
+		t.Errorf("failed refresh kept tunnels %v", s.tunnels)
+	}
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	ss "github.com/elvizlai/sskcp/shadowsocks"
+)
+
+const (
+	udpBufSize = 64 * 1024
+	udpTimeout = 60 * time.Second // idle time before a UDP association is dropped
+)
+
+var errShortUDP = errors.New("udp packet too short for address header")
+
+// rawAddrLen returns the length of the shadowsocks address header at the
+// start of b.
+func rawAddrLen(b []byte) (int, error) {
+	const (
+		typeIPv4 = 1
+		typeDm   = 3
+		typeIPv6 = 4
+	)
+	if len(b) < 1 {
+		return 0, errShortUDP
+	}
+	var n int
+	switch b[0] & ss.AddrMask {
+	case typeIPv4:
+		n = 1 + net.IPv4len + 2
+	case typeIPv6:
+		n = 1 + net.IPv6len + 2
+	case typeDm:
+		if len(b) < 2 {
+			return 0, errShortUDP
+		}
+		n = 1 + 1 + int(b[1]) + 2
+	default:
+		return 0, errAddrType
+	}
+	if len(b) < n {
+		return 0, errShortUDP
+	}
+	return n, nil
+}
+
+// udpRelay carries the datagrams of one local association through the
+// shadowsocks server's UDP relay. The KCP tunnel only carries TCP, so this
+// always talks to the server directly.
+type udpRelay struct {
+	conn    *ss.SecurePacketConn
+	server  net.Addr
+	timeout time.Duration
+}
+
+func dialUDPRelay() (*udpRelay, error) {
+	p := getPool()
+	if p == nil || len(p.servers) == 0 {
+		return nil, errNoServer
+	}
+	// prefer the first server in strategy order with a closed breaker
+	order := p.balancer.order("")
+	se := p.servers[order[0]]
+	for _, i := range order {
+		if s := p.servers[i]; atomic.LoadInt32(&s.state) == breakerClosed {
+			se = s
+			break
+		}
+	}
+	addr, err := net.ResolveUDPAddr("udp", se.addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	return &udpRelay{ss.NewSecurePacketConn(pc, se.cipher.Copy(), se.ota), addr, udpTimeout}, nil
+}
+
+// WriteTo sends payload to the destination encoded in rawaddr.
+func (r *udpRelay) WriteTo(rawaddr, payload []byte) error {
+	b := make([]byte, 0, len(rawaddr)+len(payload))
+	b = append(append(b, rawaddr...), payload...)
+	_, err := r.conn.WriteTo(b, r.server)
+	return err
+}
+
+// ReadFrom waits for the next reply and returns its payload with the
+// address header stripped. It fails once no reply arrives within r.timeout.
+func (r *udpRelay) ReadFrom(b []byte) ([]byte, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	n, _, err := r.conn.ReadFrom(b)
+	if err != nil {
+		return nil, err
+	}
+	hl, err := rawAddrLen(b[:n])
+	if err != nil {
+		return nil, err
+	}
+	return b[hl:n], nil
+}
+
+func (r *udpRelay) Close() error {
+	return r.conn.Close()
+}
@@ -0,0 +1,47 @@
+// Package netutil has the network helpers shared by the shadowsocks and KCP
+// sides.
+package netutil
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// AcceptErrors counts failed Accept calls of all listeners, read it with
+// atomic.LoadUint64. Listeners closed on purpose, like a port closed to
+// update its password, don't count.
+var AcceptErrors uint64
+
+const maxAcceptDelay = time.Second
+
+// RetryAccept handles an Accept error the way net/http's server does. On a
+// temporary error, like running out of file descriptors, it sleeps for a
+// delay doubling from 5ms to 1s and reports true so the caller accepts
+// again; tempDelay keeps the delay and must be reset after a success. Other
+// errors, like a closed listener, are final.
+func RetryAccept(err error, tempDelay *time.Duration) bool {
+	if Closed(err) {
+		return false
+	}
+	atomic.AddUint64(&AcceptErrors, 1)
+	if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+		return false
+	}
+	if *tempDelay == 0 {
+		*tempDelay = 5 * time.Millisecond
+	} else if *tempDelay *= 2; *tempDelay > maxAcceptDelay {
+		*tempDelay = maxAcceptDelay
+	}
+	log.Printf("accept error: %v; retrying in %v\n", err, *tempDelay)
+	time.Sleep(*tempDelay)
+	return true
+}
+
+// Closed reports whether err comes from a listener or connection closed on
+// purpose.
+func Closed(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
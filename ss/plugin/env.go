@@ -0,0 +1,93 @@
+package plugin
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// FromEnv returns the addresses and options a shadowsocks implementation
+// passes when running us as its plugin, ok is false otherwise.
+func FromEnv() (remote, local, opts string, ok bool) {
+	remoteHost, remotePort := os.Getenv("SS_REMOTE_HOST"), os.Getenv("SS_REMOTE_PORT")
+	localHost, localPort := os.Getenv("SS_LOCAL_HOST"), os.Getenv("SS_LOCAL_PORT")
+	if remoteHost == "" || remotePort == "" || localHost == "" || localPort == "" {
+		return "", "", "", false
+	}
+	return net.JoinHostPort(remoteHost, remotePort), net.JoinHostPort(localHost, localPort),
+		os.Getenv("SS_PLUGIN_OPTIONS"), true
+}
+
+// ParseOptions splits plugin options like "mode=fast;nocomp", where a
+// backslash escapes the next character. Options without a value are "true".
+func ParseOptions(opts string) ([][2]string, error) {
+	var parsed [][2]string
+	var key, cur []rune
+	inValue := false
+	flush := func() {
+		if !inValue {
+			if len(cur) > 0 {
+				parsed = append(parsed, [2]string{string(cur), "true"})
+			}
+		} else {
+			parsed = append(parsed, [2]string{string(key), string(cur)})
+		}
+		key, cur, inValue = nil, nil, false
+	}
+	escaped := false
+	for _, r := range opts {
+		switch {
+		case escaped:
+			cur = append(cur, r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ';':
+			flush()
+		case r == '=' && !inValue:
+			if len(cur) == 0 {
+				return nil, fmt.Errorf("plugin option without a name in %q", opts)
+			}
+			key, cur, inValue = cur, nil, true
+		default:
+			cur = append(cur, r)
+		}
+	}
+	if escaped {
+		return nil, errors.New("plugin options end in a backslash")
+	}
+	flush()
+	return parsed, nil
+}
+
+// FormatOptions joins options for ParseOptions, escaping the separators in
+// them.
+func FormatOptions(opts [][2]string) string {
+	esc := strings.NewReplacer(`\`, `\\`, ";", `\;`, "=", `\=`)
+	parts := make([]string, len(opts))
+	for i, kv := range opts {
+		parts[i] = esc.Replace(kv[0]) + "=" + esc.Replace(kv[1])
+	}
+	return strings.Join(parts, ";")
+}
+
+// SetFlags applies plugin options to the command line flags of the same
+// names.
+func SetFlags(opts string) error {
+	parsed, err := ParseOptions(opts)
+	if err != nil {
+		return err
+	}
+	for _, kv := range parsed {
+		if flag.Lookup(kv[0]) == nil {
+			return fmt.Errorf("unknown plugin option %s", kv[0])
+		}
+		if err := flag.Set(kv[0], kv[1]); err != nil {
+			return fmt.Errorf("plugin option %s: %v", kv[0], err)
+		}
+	}
+	return nil
+}
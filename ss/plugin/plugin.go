@@ -0,0 +1,162 @@
+// Package plugin runs SIP003 plugins, external programs like simple-obfs or
+// v2ray-plugin that carry shadowsocks traffic between a local and a remote
+// address in their own way, and lets sskcp run as one.
+package plugin
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	minBackoff = time.Second // restart delay after a crash
+	maxBackoff = time.Minute // the delay doubles per crash up to this
+	stableRun  = time.Minute // a plugin running this long resets the delay
+	stopWait   = 3 * time.Second
+)
+
+// KCPClient is the name of the sskcp client run as the plugin of other
+// shadowsocks clients, carrying their traffic over a KCP tunnel.
+const KCPClient = "sskcp_client"
+
+var errStopped = errors.New("plugin stopped")
+
+// Plugin is a running plugin process, restarted whenever it exits until
+// Stop.
+type Plugin struct {
+	name string
+	env  []string
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stopped bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Start runs the plugin name with options opts. Per SIP003, it accepts on
+// local and connects to remote on the client, the other way round on the
+// server.
+func Start(name, opts, remote, local string) (*Plugin, error) {
+	remoteHost, remotePort, err := net.SplitHostPort(remote)
+	if err != nil {
+		return nil, err
+	}
+	localHost, localPort, err := net.SplitHostPort(local)
+	if err != nil {
+		return nil, err
+	}
+	p := &Plugin{
+		name: name,
+		env: append(os.Environ(),
+			"SS_REMOTE_HOST="+remoteHost,
+			"SS_REMOTE_PORT="+remotePort,
+			"SS_LOCAL_HOST="+localHost,
+			"SS_LOCAL_PORT="+localPort,
+			"SS_PLUGIN_OPTIONS="+opts,
+		),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	log.Printf("plugin %s started, %s <-> %s\n", name, local, remote)
+	go p.supervise()
+	return p, nil
+}
+
+func (p *Plugin) start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return errStopped
+	}
+	cmd := exec.Command(p.name)
+	cmd.Env = p.env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	setSysProcAttr(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd = cmd
+	return nil
+}
+
+// supervise restarts the plugin with exponential backoff when it exits.
+func (p *Plugin) supervise() {
+	defer close(p.done)
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		err := p.cmd.Wait()
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		if time.Since(started) >= stableRun {
+			backoff = minBackoff
+		}
+		log.Printf("plugin %s exited: %v, restarting in %v\n", p.name, err, backoff)
+		for {
+			select {
+			case <-time.After(backoff):
+			case <-p.stop:
+				return
+			}
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			if err = p.start(); err == nil {
+				break
+			}
+			if err == errStopped {
+				return
+			}
+			log.Printf("plugin %s: %v, retrying in %v\n", p.name, err, backoff)
+		}
+	}
+}
+
+// Stop terminates the plugin, killing it if it doesn't exit in time.
+func (p *Plugin) Stop() {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return
+	}
+	p.stopped = true
+	close(p.stop)
+	proc := p.cmd.Process
+	p.mu.Unlock()
+
+	if err := proc.Signal(syscall.SIGTERM); err != nil {
+		proc.Kill()
+	}
+	select {
+	case <-p.done:
+	case <-time.After(stopWait):
+		proc.Kill()
+		<-p.done
+	}
+	log.Printf("plugin %s stopped\n", p.name)
+}
+
+// FreePort returns a local address with a TCP port free for a plugin to
+// listen on.
+func FreePort() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
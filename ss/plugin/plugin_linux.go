@@ -0,0 +1,11 @@
+package plugin
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setSysProcAttr makes the plugin exit with us.
+func setSysProcAttr(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+}
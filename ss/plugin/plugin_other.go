@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package plugin
+
+import "os/exec"
+
+func setSysProcAttr(cmd *exec.Cmd) {}
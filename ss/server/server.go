@@ -14,8 +14,11 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	ss "github.com/elvizlai/sskcp/shadowsocks"
+	"github.com/elvizlai/sskcp/ss/netutil"
+	"github.com/elvizlai/sskcp/ss/plugin"
 )
 
 const (
@@ -37,6 +40,10 @@ const (
 var Debug ss.DebugLog
 var UDP bool
 
+// Plugin is a SIP003 plugin taking connections on the server ports in front
+// of the server, which then listens on loopback, PluginOpts are its options.
+var Plugin, PluginOpts string
+
 func getRequest(conn *ss.Conn, auth bool) (host string, ota bool, err error) {
 	ss.SetReadTimeout(conn)
 
@@ -279,6 +286,9 @@ func updatePasswd() {
 	if err = UnifyPortPassword(Config); err != nil {
 		return
 	}
+	if err = LoadTokens(); err != nil {
+		log.Printf("error reading tokens from %s: %v\n", ConfigFile, err)
+	}
 	for port, passwd := range Config.PortPassword {
 		passwdManager.updatePortPasswd(port, passwd, Config.Auth)
 		if oldconfig.PortPassword != nil {
@@ -308,21 +318,39 @@ func WaitSignal() {
 }
 
 func Run(port, password string, auth bool) {
-	ln, err := net.Listen("tcp", ":"+port)
+	addr := ":" + port
+	if Plugin != "" {
+		addr = "127.0.0.1:0"
+	}
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		log.Printf("error listening port %v: %v\n", port, err)
 		os.Exit(1)
 	}
 	passwdManager.add(port, password, ln)
+	if Plugin != "" {
+		// the plugin lives as long as the listener
+		p, err := plugin.Start(Plugin, PluginOpts, net.JoinHostPort("0.0.0.0", port), ln.Addr().String())
+		if err != nil {
+			log.Printf("error starting plugin %s for port %v: %v\n", Plugin, port, err)
+			os.Exit(1)
+		}
+		defer p.Stop()
+	}
 	var cipher *ss.Cipher
 	log.Printf("server listening port %v ...\n", port)
+	var tempDelay time.Duration
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if netutil.RetryAccept(err, &tempDelay) {
+				continue
+			}
 			// listener maybe closed to update password
 			Debug.Printf("accept error: %v\n", err)
 			return
 		}
+		tempDelay = 0
 		// Creating cipher upon first connection.
 		if cipher == nil {
 			log.Println("creating cipher for port:", port)
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+
+	c "github.com/elvizlai/sskcp/config"
+	"github.com/elvizlai/sskcp/kcptun"
+	"github.com/elvizlai/sskcp/ss/plugin"
+	"github.com/elvizlai/sskcp/ss/uri"
+)
+
+// Ports are shared as clients reach them, over their KCP tunnels with the
+// sskcp client as SIP003 plugin, in ss:// URIs and SIP008 documents.
+
+// KCPPluginOpts are the options of the sskcp client, run as plugin, that
+// match the KCP tunnel settings of the server. The client takes WebSocket if
+// the server has it, through its public URL if it has one, else QUIC if it
+// has it, else KCP. The TCP fallback is added where it applies, and TLS is
+// verified against the name in the certificate, or skipped for the server's
+// self-signed one, except through the public URL, which verifies its host.
+func KCPPluginOpts() string {
+	opts := [][2]string{{"key", c.Key}, {"datashard", strconv.Itoa(c.DataShard)}}
+	if c.Obfs != "" {
+		opts = append(opts, [2]string{"obfs", c.Obfs}, [2]string{"obfslen", c.ObfsLength})
+	}
+	certified := c.TLSCert != "" || c.TLSKey != ""
+	useTLS := certified
+	switch {
+	case c.WS:
+		transport := kcptun.TransportWS
+		if certified {
+			transport = kcptun.TransportWSS
+		}
+		if u, err := kcptun.ParseWSURL(c.WSURL); err == nil {
+			// e.g. a CDN, terminating TLS or not whatever the server does
+			opts = append(opts, [2]string{"transport", u.Scheme}, [2]string{"wsurl", c.WSURL})
+			useTLS = false
+		} else {
+			opts = append(opts, [2]string{"transport", transport}, [2]string{"wspath", c.WSPath})
+		}
+	case c.QUIC:
+		opts = append(opts, [2]string{"transport", kcptun.TransportQUIC})
+		useTLS = true
+	}
+	if c.TCP && !c.WS {
+		fallback := kcptun.TransportTCP
+		if certified {
+			fallback = kcptun.TransportTLS
+		}
+		opts = append(opts, [2]string{"fallback", fallback})
+	}
+	if useTLS {
+		if !certified {
+			opts = append(opts, [2]string{"tlsinsecure", "true"})
+		} else if name := certName(c.TLSCert, c.TLSKey); name != "" {
+			opts = append(opts, [2]string{"tlsname", name})
+		}
+	}
+	return plugin.FormatOptions(opts)
+}
+
+// certName returns the first DNS name of a certificate, "" if there is none.
+func certName(certFile, keyFile string) string {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil || len(cert.Certificate) == 0 {
+		return ""
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || len(leaf.DNSNames) == 0 {
+		return ""
+	}
+	return leaf.DNSNames[0]
+}
+
+// Servers describes the ports of portPassword at host, sorted by port.
+func Servers(host string, portPassword map[string]string) ([]*uri.Server, error) {
+	ports := make([]int, 0, len(portPassword))
+	for port := range portPassword {
+		portNumeric, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, portNumeric)
+	}
+	sort.Ints(ports)
+	if c.WS && c.WSURL != "" && len(ports) > 1 {
+		return nil, errors.New("the websocket url reaches a single port")
+	}
+
+	method := Config.Method
+	if Config.Auth {
+		method += "-auth"
+	}
+	opts := KCPPluginOpts()
+	srvs := make([]*uri.Server, len(ports))
+	for i, port := range ports {
+		srvs[i] = &uri.Server{
+			Tag:        net.JoinHostPort(host, strconv.Itoa(port)),
+			Host:       host,
+			Port:       kcptun.PortOffset + port,
+			Password:   portPassword[strconv.Itoa(port)],
+			Method:     method,
+			Plugin:     plugin.KCPClient,
+			PluginOpts: opts,
+		}
+	}
+	return srvs, nil
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/elvizlai/sskcp/ss/uri"
+)
+
+// SIP008 returns the online configuration of the ports of portPassword at
+// host.
+func SIP008(host string, portPassword map[string]string) (*uri.Online, error) {
+	srvs, err := Servers(host, portPassword)
+	if err != nil {
+		return nil, err
+	}
+	return &uri.Online{Version: uri.SIP008Version, Servers: srvs}, nil
+}
+
+// UserPorts picks the ports of a user token from portPassword, ok is false
+// for unknown tokens.
+func UserPorts(token string, portPassword map[string]string) (map[string]string, bool) {
+	ports, ok := getTokens()[token]
+	if !ok {
+		return nil, false
+	}
+	picked := make(map[string]string)
+	for _, port := range ports {
+		if password, ok := portPassword[port]; ok {
+			picked[port] = password
+		}
+	}
+	return picked, true
+}
+
+// tokens maps a user token to the ports in the SIP008 document of that user,
+// "tokens" in the config file, reloaded with the passwords.
+var tokens struct {
+	sync.Mutex
+	m map[string][]string
+}
+
+func getTokens() map[string][]string {
+	tokens.Lock()
+	defer tokens.Unlock()
+	return tokens.m
+}
+
+// LoadTokens reads the user tokens from the config file.
+func LoadTokens() error {
+	data, err := ioutil.ReadFile(ConfigFile)
+	if err != nil {
+		return err
+	}
+	var config struct {
+		Tokens map[string][]string `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	tokens.Lock()
+	tokens.m = config.Tokens
+	tokens.Unlock()
+	return nil
+}
+
+// passwords returns the ports being served with their passwords.
+func (pm *PasswdManager) passwords() map[string]string {
+	pm.Lock()
+	defer pm.Unlock()
+	m := make(map[string]string, len(pm.portListener))
+	for port, pl := range pm.portListener {
+		m[port] = pl.password
+	}
+	return m
+}
+
+// RunAdmin serves the SIP008 document of the ports of a user on
+// http://listenAddr/sip008/TOKEN, the only route, as the endpoint may be
+// public: the document of all ports is left to the sip008 command.
+// Servers are at host, the host the request was sent to if empty.
+func RunAdmin(listenAddr, host string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sip008/", func(w http.ResponseWriter, r *http.Request) {
+		portPassword, ok := UserPorts(strings.TrimPrefix(r.URL.Path, "/sip008/"), passwdManager.passwords())
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		h := host
+		if h == "" {
+			if h, _, _ = net.SplitHostPort(r.Host); h == "" {
+				h = r.Host
+			}
+		}
+		doc, err := SIP008(h, portPassword)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(doc)
+	})
+	log.Printf("admin endpoint at http://%v/sip008/TOKEN\n", listenAddr)
+	log.Fatal(http.ListenAndServe(listenAddr, mux))
+}
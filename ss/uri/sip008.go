@@ -0,0 +1,59 @@
+package uri
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// SIP008Version is the version of SIP008 documents.
+const SIP008Version = 1
+
+// Online is a SIP008 online configuration, the server list of a provider.
+type Online struct {
+	Version int       `json:"version"`
+	Servers []*Server `json:"servers"`
+}
+
+// ParseSubscription reads a server list, a SIP008 document or ss:// URIs one
+// per line, the lines usually base64 encoded as a whole.
+func ParseSubscription(data []byte) ([]*Server, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("{")) {
+		var doc Online
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		if doc.Version != SIP008Version {
+			return nil, fmt.Errorf("unknown SIP008 version %d", doc.Version)
+		}
+		for _, srv := range doc.Servers {
+			if srv == nil || srv.Host == "" || srv.Port <= 0 || srv.Port > 0xffff || srv.Method == "" {
+				return nil, fmt.Errorf("bad SIP008 server %+v", srv)
+			}
+		}
+		return doc.Servers, nil
+	}
+
+	if !bytes.HasPrefix(data, []byte(scheme)) {
+		b, err := decodeBase64(strings.Join(strings.Fields(string(data)), ""))
+		if err != nil {
+			return nil, fmt.Errorf("server list is neither SIP008, ss:// URIs nor base64: %v", err)
+		}
+		data = b
+	}
+	var srvs []*Server
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		srv, err := Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		srvs = append(srvs, srv)
+	}
+	return srvs, nil
+}
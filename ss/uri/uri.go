@@ -0,0 +1,134 @@
+// Package uri reads and writes ss:// URIs, the SIP002 format shadowsocks
+// clients share servers in:
+//
+//	ss://base64url(method:password)@host:port/?plugin=name%3Bopts#tag
+//
+// Parse also takes the legacy ss://base64(method:password@host:port)#tag.
+// Server lists come as SIP008 documents or in base64, see ParseSubscription.
+package uri
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const scheme = "ss://"
+
+// Server is a shadowsocks server with its SIP003 plugin, if any. It's also
+// the server object of SIP008.
+type Server struct {
+	ID         string `json:"id,omitempty"`
+	Tag        string `json:"remarks,omitempty"`
+	Host       string `json:"server"`
+	Port       int    `json:"server_port"`
+	Password   string `json:"password"`
+	Method     string `json:"method"`
+	Plugin     string `json:"plugin,omitempty"`
+	PluginOpts string `json:"plugin_opts,omitempty"`
+}
+
+// Addr returns host:port of the server.
+func (s *Server) Addr() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// String returns the SIP002 URI of the server.
+func (s *Server) String() string {
+	u := &url.URL{
+		Scheme:   "ss",
+		User:     url.User(base64.RawURLEncoding.EncodeToString([]byte(s.Method + ":" + s.Password))),
+		Host:     s.Addr(),
+		Fragment: s.Tag,
+	}
+	if s.Plugin != "" {
+		plugin := s.Plugin
+		if s.PluginOpts != "" {
+			plugin += ";" + s.PluginOpts
+		}
+		u.Path = "/"
+		u.RawQuery = url.Values{"plugin": {plugin}}.Encode()
+	}
+	return u.String()
+}
+
+// Parse reads an ss:// URI.
+func Parse(s string) (*Server, error) {
+	if !strings.HasPrefix(s, scheme) {
+		return nil, fmt.Errorf("not an ss:// URI: %q", s)
+	}
+	rest, tag := s[len(scheme):], ""
+	if i := strings.IndexByte(rest, '#'); i >= 0 {
+		var err error
+		if tag, err = url.PathUnescape(rest[i+1:]); err != nil {
+			return nil, err
+		}
+		rest = rest[:i]
+	}
+
+	var userinfo, hostport string
+	var query url.Values
+	if !strings.Contains(rest, "@") {
+		// legacy, everything in base64
+		b, err := decodeBase64(rest)
+		if err != nil {
+			return nil, fmt.Errorf("bad ss:// URI: %v", err)
+		}
+		i := strings.LastIndexByte(string(b), '@')
+		if i < 0 {
+			return nil, errors.New("bad ss:// URI: no server address")
+		}
+		userinfo, hostport = string(b[:i]), string(b[i+1:])
+	} else {
+		u, err := url.Parse(scheme + rest)
+		if err != nil {
+			return nil, err
+		}
+		if password, ok := u.User.Password(); ok {
+			// SIP002 allows method:password unencoded for AEAD ciphers
+			userinfo = u.User.Username() + ":" + password
+		} else {
+			b, err := decodeBase64(u.User.Username())
+			if err != nil {
+				return nil, fmt.Errorf("bad ss:// URI user info: %v", err)
+			}
+			userinfo = string(b)
+		}
+		hostport, query = u.Host, u.Query()
+	}
+
+	srv := &Server{Tag: tag}
+	i := strings.IndexByte(userinfo, ':')
+	if i < 0 {
+		return nil, errors.New("bad ss:// URI: no password")
+	}
+	srv.Method, srv.Password = userinfo[:i], userinfo[i+1:]
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("bad ss:// URI: %v", err)
+	}
+	if srv.Port, err = strconv.Atoi(port); err != nil || srv.Port <= 0 || srv.Port > 0xffff {
+		return nil, fmt.Errorf("bad ss:// URI port %q", port)
+	}
+	srv.Host = host
+	if plugin := query.Get("plugin"); plugin != "" {
+		srv.Plugin = plugin
+		if i := strings.IndexByte(plugin, ';'); i >= 0 {
+			srv.Plugin, srv.PluginOpts = plugin[:i], plugin[i+1:]
+		}
+	}
+	return srv, nil
+}
+
+// decodeBase64 takes standard or URL-safe base64, padded or not.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "+/") {
+		return base64.RawStdEncoding.DecodeString(s)
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}